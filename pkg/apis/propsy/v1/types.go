@@ -5,36 +5,223 @@ import (
 )
 
 type ProPsyServiceSpec struct {
-	Service                               string   `json:"service"`
-	ServicePort                           int      `json:"servicePort"`
-	Listen                                string   `json:"listen"`
-	Percent                               int      `json:"percent"`
-	Nodes                                 []string `json:"nodes"`
-	CanaryService                         string   `json:"canaryService"`
-	CanaryPercent                         int      `json:"canaryPercent"`
-	Timeout                               int      `json:"timeout"`
-	ConnectTimeout                        int      `json:"connectTimeout"`
-	MaxRequestsPerConnection              int      `json:"maxRequestsPerConnection"`
-	Type                                  string   `json:"type"`
-	PathPrefix                            string   `json:"pathPrefix"`
-	PrefixRewrite                         string   `json:"prefixRewrite"`
-	TLSCertificateSecret                  string   `json:"tlsCertificateSecret"`
-	HealthCheckTimeout                    int      `json:"healthCheckTimeout"`
-	HealthCheckInterval                   int      `json:"healthCheckInterval"`
-	HealthCheckUnhealthyTreshold          int      `json:"healthCheckUnhealthyTreshold"`
-	HealthCheckHealthyTreshold            int      `json:"healthCheckHealthyTreshold"`
-	HealthCheckReuseConnection            bool     `json:"healthCheckReuseConnection"`
-	HealthCheckHealthChecker              string   `json:"healthCheckType"`
-	HealthCheckHTTPPath                   string   `json:"healthCheckHTTPPath"`
-	HealthCheckHTTPHost                   string   `json:"healthCheckHTTPHost"`
-	HealthCheckOutlierEnabled             bool     `json:"healthCheckOutlierEnabled"`
-	HealthCheckOutlierConsecutiveErrors   int      `json:"healthCheckOutlierConsecutiveErrors"`
-	HealthCheckOutlierConsecutiveGwErrors int      `json:"healthCheckOutlierConsecutiveGwErrors"`
-	HealthCheckOutlierInterval            int      `json:"healthCheckOutlierInterval"`
-	HealthCheckOutlierEjectionTime        int      `json:"healthCheckOutlierEjectionTime"`
-	HealthCheckOutlierEjectionPercent     int      `json:"healthCheckOutlierEjectionPercent"`
-	HealthCheckOutlierMinimumHosts        int      `json:"healthCheckOutlierMinimumHosts"`
-	HealthCheckOutlierMinimumRequests     int      `json:"healthCheckOutlierMinimumRequests"`
+	Service                               string                             `json:"service"`
+	ServicePort                           int                                `json:"servicePort"`
+	Listen                                string                             `json:"listen"`
+	Percent                               int                                `json:"percent"`
+	Nodes                                 []string                           `json:"nodes"`
+	CanaryService                         string                             `json:"canaryService"`
+	CanaryPercent                         int                                `json:"canaryPercent"`
+	MirrorService                         string                             `json:"mirrorService"`
+	MirrorPercent                         int                                `json:"mirrorPercent"`
+	Timeout                               int                                `json:"timeout"`
+	ConnectTimeout                        int                                `json:"connectTimeout"`
+	MaxRequestsPerConnection              int                                `json:"maxRequestsPerConnection"`
+	Type                                  string                             `json:"type"`
+	PathPrefix                            string                             `json:"pathPrefix"`
+	PrefixRewrite                         string                             `json:"prefixRewrite"`
+	TLSCertificateSecret                  string                             `json:"tlsCertificateSecret"`
+	HealthCheckTimeout                    int                                `json:"healthCheckTimeout"`
+	HealthCheckInterval                   int                                `json:"healthCheckInterval"`
+	HealthCheckUnhealthyTreshold          int                                `json:"healthCheckUnhealthyTreshold"`
+	HealthCheckHealthyTreshold            int                                `json:"healthCheckHealthyTreshold"`
+	HealthCheckReuseConnection            bool                               `json:"healthCheckReuseConnection"`
+	HealthCheckHealthChecker              string                             `json:"healthCheckType"`
+	HealthCheckHTTPPath                   string                             `json:"healthCheckHTTPPath"`
+	HealthCheckHTTPHost                   string                             `json:"healthCheckHTTPHost"`
+	HealthCheckOutlierEnabled             bool                               `json:"healthCheckOutlierEnabled"`
+	HealthCheckOutlierConsecutiveErrors   int                                `json:"healthCheckOutlierConsecutiveErrors"`
+	HealthCheckOutlierConsecutiveGwErrors int                                `json:"healthCheckOutlierConsecutiveGwErrors"`
+	HealthCheckOutlierInterval            int                                `json:"healthCheckOutlierInterval"`
+	HealthCheckOutlierEjectionTime        int                                `json:"healthCheckOutlierEjectionTime"`
+	HealthCheckOutlierEjectionPercent     int                                `json:"healthCheckOutlierEjectionPercent"`
+	HealthCheckOutlierMinimumHosts        int                                `json:"healthCheckOutlierMinimumHosts"`
+	HealthCheckOutlierMinimumRequests     int                                `json:"healthCheckOutlierMinimumRequests"`
+	Match                                 ProPsyServiceMatch                 `json:"match"`
+	Domains                               []string                           `json:"domains"`
+	ClientCASecret                        string                             `json:"clientCASecret"`
+	ClientAllowedSANs                     []string                           `json:"clientAllowedSANs"`
+	UpstreamTLSEnabled                    bool                               `json:"upstreamTLSEnabled"`
+	UpstreamTLSSNI                        string                             `json:"upstreamTLSSNI"`
+	UpstreamTLSCASecret                   string                             `json:"upstreamTLSCASecret"`
+	UpstreamTLSCertificateSecret          string                             `json:"upstreamTLSCertificateSecret"`
+	RetryPolicy                           ProPsyServiceRetryPolicy           `json:"retryPolicy"`
+	CircuitBreakers                       ProPsyServiceCircuitBreakers       `json:"circuitBreakers"`
+	LBPolicy                              string                             `json:"lbPolicy"`
+	HashPolicy                            []ProPsyServiceHashPolicy          `json:"hashPolicy"`
+	FaultInjection                        ProPsyServiceFaultInjection        `json:"faultInjection"`
+	LocalRateLimit                        ProPsyServiceLocalRateLimit        `json:"localRateLimit"`
+	RateLimitDescriptors                  []ProPsyServiceRateLimitDescriptor `json:"rateLimitDescriptors"`
+	ProPsyServiceHeaders                  `json:",inline"`
+	VHostHeaders                          ProPsyServiceHeaders        `json:"vhostHeaders"`
+	Redirect                              ProPsyServiceRedirect       `json:"redirect"`
+	DirectResponse                        ProPsyServiceDirectResponse `json:"directResponse"`
+	Cors                                  ProPsyServiceCors           `json:"cors"`
+	AccessLog                             ProPsyServiceAccessLog      `json:"accessLog"`
+	Compression                           ProPsyServiceCompression    `json:"compression"`
+	ExtAuthz                              ProPsyServiceExtAuthz       `json:"extAuthz"`
+	JWT                                   ProPsyServiceJWT            `json:"jwt"`
+	UpstreamProtocol                      string                      `json:"upstreamProtocol"`
+	WebSocket                             bool                        `json:"websocket"`
+	AcceptProxyProtocol                   bool                        `json:"acceptProxyProtocol"`
+	UpstreamProxyProtocol                 string                      `json:"upstreamProxyProtocol"`
+}
+
+type ProPsyServiceJWT struct {
+	Issuer               string   `json:"issuer"`
+	Audiences            []string `json:"audiences"`
+	JWKSSecret           string   `json:"jwksSecret"`
+	RemoteJWKSURI        string   `json:"remoteJwksUri"`
+	RemoteJWKSCluster    string   `json:"remoteJwksCluster"`
+	Forward              bool     `json:"forward"`
+	ForwardPayloadHeader string   `json:"forwardPayloadHeader"`
+}
+
+type ProPsyServiceExtAuthz struct {
+	Service          string `json:"service"`
+	ServicePort      int    `json:"servicePort"`
+	Protocol         string `json:"protocol"`
+	PathPrefix       string `json:"pathPrefix"`
+	Timeout          int    `json:"timeout"` // ms
+	FailureModeAllow bool   `json:"failureModeAllow"`
+}
+
+type ProPsyServiceCompression struct {
+	Enabled      bool     `json:"enabled"`
+	ContentTypes []string `json:"contentTypes"`
+	MinLength    int      `json:"minLength"`
+	Level        string   `json:"level"`
+	Disabled     bool     `json:"disabled"`
+}
+
+type ProPsyServiceAccessLog struct {
+	Path          string `json:"path"`
+	Cluster       string `json:"cluster"`
+	Format        string `json:"format"`
+	MinStatus     int    `json:"minStatus"`
+	SamplePercent int    `json:"samplePercent"`
+	Disabled      bool   `json:"disabled"`
+}
+
+type ProPsyServiceCors struct {
+	AllowOrigins     []string `json:"allowOrigins"`
+	AllowOriginRegex []string `json:"allowOriginRegex"`
+	AllowMethods     []string `json:"allowMethods"`
+	AllowHeaders     []string `json:"allowHeaders"`
+	ExposeHeaders    []string `json:"exposeHeaders"`
+	MaxAge           int      `json:"maxAge"` // seconds
+	AllowCredentials bool     `json:"allowCredentials"`
+	Scope            string   `json:"scope"`
+}
+
+type ProPsyServiceRedirect struct {
+	HTTPSRedirect bool   `json:"httpsRedirect"`
+	Host          string `json:"host"`
+	Port          int    `json:"port"`
+	Path          string `json:"path"`
+	ResponseCode  int    `json:"responseCode"`
+	StripQuery    bool   `json:"stripQuery"`
+}
+
+type ProPsyServiceDirectResponse struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+type ProPsyServiceHeaders struct {
+	RequestHeadersToAdd     []ProPsyServiceHeaderValue `json:"requestHeadersToAdd"`
+	RequestHeadersToRemove  []string                   `json:"requestHeadersToRemove"`
+	ResponseHeadersToAdd    []ProPsyServiceHeaderValue `json:"responseHeadersToAdd"`
+	ResponseHeadersToRemove []string                   `json:"responseHeadersToRemove"`
+}
+
+type ProPsyServiceHeaderValue struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Append bool   `json:"append"`
+}
+
+type ProPsyServiceRateLimitDescriptor struct {
+	Actions []ProPsyServiceRateLimitAction `json:"actions"`
+}
+
+type ProPsyServiceRateLimitAction struct {
+	Header        string `json:"header"`
+	DescriptorKey string `json:"descriptorKey"`
+	RemoteAddress bool   `json:"remoteAddress"`
+	GenericKey    string `json:"genericKey"`
+}
+
+type ProPsyServiceLocalRateLimit struct {
+	Requests int    `json:"requests"`
+	Unit     string `json:"unit"`
+	Burst    int    `json:"burst"`
+	Scope    string `json:"scope"`
+}
+
+type ProPsyServiceFaultInjection struct {
+	DelayPercent int                        `json:"delayPercent"`
+	Delay        int                        `json:"delay"`
+	AbortPercent int                        `json:"abortPercent"`
+	AbortStatus  int                        `json:"abortStatus"`
+	Headers      []ProPsyServiceHeaderMatch `json:"headers"`
+}
+
+type ProPsyServiceHashPolicy struct {
+	Header     string `json:"header"`
+	Cookie     string `json:"cookie"`
+	CookieTTL  int    `json:"cookieTTL"`
+	CookiePath string `json:"cookiePath"`
+	SourceIP   bool   `json:"sourceIP"`
+	Terminal   bool   `json:"terminal"`
+}
+
+type ProPsyServiceCircuitBreakers struct {
+	Default ProPsyServiceCircuitBreakerThresholds `json:"default"`
+	High    ProPsyServiceCircuitBreakerThresholds `json:"high"`
+}
+
+type ProPsyServiceCircuitBreakerThresholds struct {
+	MaxConnections     int `json:"maxConnections"`
+	MaxPendingRequests int `json:"maxPendingRequests"`
+	MaxRequests        int `json:"maxRequests"`
+	MaxRetries         int `json:"maxRetries"`
+}
+
+type ProPsyServiceRetryPolicy struct {
+	RetryOn                  string `json:"retryOn"`
+	NumRetries               int    `json:"numRetries"`
+	PerTryTimeout            int    `json:"perTryTimeout"`
+	RetriableStatusCodes     []int  `json:"retriableStatusCodes"`
+	AvoidPreviousHosts       bool   `json:"avoidPreviousHosts"`
+	HostSelectionMaxAttempts int    `json:"hostSelectionMaxAttempts"`
+	BackOffBaseInterval      int    `json:"backOffBaseInterval"`
+	BackOffMaxInterval       int    `json:"backOffMaxInterval"`
+	BudgetPercent            int    `json:"budgetPercent"`
+	MinRetryConcurrency      int    `json:"minRetryConcurrency"`
+}
+
+type ProPsyServiceMatch struct {
+	Path            string                             `json:"path"`
+	Regex           string                             `json:"regex"`
+	Method          string                             `json:"method"`
+	Headers         []ProPsyServiceHeaderMatch         `json:"headers"`
+	QueryParameters []ProPsyServiceQueryParameterMatch `json:"queryParameters"`
+}
+
+type ProPsyServiceHeaderMatch struct {
+	Name   string `json:"name"`
+	Exact  string `json:"exact"`
+	Regex  string `json:"regex"`
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+	Invert bool   `json:"invert"`
+}
+
+type ProPsyServiceQueryParameterMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Regex bool   `json:"regex"`
 }
 
 // +genclient
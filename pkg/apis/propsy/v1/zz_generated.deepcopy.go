@@ -38,6 +38,276 @@ func (in *ProPsyService) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceAccessLog) DeepCopyInto(out *ProPsyServiceAccessLog) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceAccessLog.
+func (in *ProPsyServiceAccessLog) DeepCopy() *ProPsyServiceAccessLog {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceAccessLog)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceCircuitBreakerThresholds) DeepCopyInto(out *ProPsyServiceCircuitBreakerThresholds) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceCircuitBreakerThresholds.
+func (in *ProPsyServiceCircuitBreakerThresholds) DeepCopy() *ProPsyServiceCircuitBreakerThresholds {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceCircuitBreakerThresholds)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceCircuitBreakers) DeepCopyInto(out *ProPsyServiceCircuitBreakers) {
+	*out = *in
+	out.Default = in.Default
+	out.High = in.High
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceCircuitBreakers.
+func (in *ProPsyServiceCircuitBreakers) DeepCopy() *ProPsyServiceCircuitBreakers {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceCircuitBreakers)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceCompression) DeepCopyInto(out *ProPsyServiceCompression) {
+	*out = *in
+	if in.ContentTypes != nil {
+		in, out := &in.ContentTypes, &out.ContentTypes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceCompression.
+func (in *ProPsyServiceCompression) DeepCopy() *ProPsyServiceCompression {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceCompression)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceCors) DeepCopyInto(out *ProPsyServiceCors) {
+	*out = *in
+	if in.AllowOrigins != nil {
+		in, out := &in.AllowOrigins, &out.AllowOrigins
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowOriginRegex != nil {
+		in, out := &in.AllowOriginRegex, &out.AllowOriginRegex
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowMethods != nil {
+		in, out := &in.AllowMethods, &out.AllowMethods
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowHeaders != nil {
+		in, out := &in.AllowHeaders, &out.AllowHeaders
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExposeHeaders != nil {
+		in, out := &in.ExposeHeaders, &out.ExposeHeaders
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceCors.
+func (in *ProPsyServiceCors) DeepCopy() *ProPsyServiceCors {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceCors)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceDirectResponse) DeepCopyInto(out *ProPsyServiceDirectResponse) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceDirectResponse.
+func (in *ProPsyServiceDirectResponse) DeepCopy() *ProPsyServiceDirectResponse {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceDirectResponse)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceExtAuthz) DeepCopyInto(out *ProPsyServiceExtAuthz) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceExtAuthz.
+func (in *ProPsyServiceExtAuthz) DeepCopy() *ProPsyServiceExtAuthz {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceExtAuthz)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceFaultInjection) DeepCopyInto(out *ProPsyServiceFaultInjection) {
+	*out = *in
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make([]ProPsyServiceHeaderMatch, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceFaultInjection.
+func (in *ProPsyServiceFaultInjection) DeepCopy() *ProPsyServiceFaultInjection {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceFaultInjection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceHashPolicy) DeepCopyInto(out *ProPsyServiceHashPolicy) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceHashPolicy.
+func (in *ProPsyServiceHashPolicy) DeepCopy() *ProPsyServiceHashPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceHashPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceHeaderMatch) DeepCopyInto(out *ProPsyServiceHeaderMatch) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceHeaderMatch.
+func (in *ProPsyServiceHeaderMatch) DeepCopy() *ProPsyServiceHeaderMatch {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceHeaderMatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceHeaderValue) DeepCopyInto(out *ProPsyServiceHeaderValue) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceHeaderValue.
+func (in *ProPsyServiceHeaderValue) DeepCopy() *ProPsyServiceHeaderValue {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceHeaderValue)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceHeaders) DeepCopyInto(out *ProPsyServiceHeaders) {
+	*out = *in
+	if in.RequestHeadersToAdd != nil {
+		in, out := &in.RequestHeadersToAdd, &out.RequestHeadersToAdd
+		*out = make([]ProPsyServiceHeaderValue, len(*in))
+		copy(*out, *in)
+	}
+	if in.RequestHeadersToRemove != nil {
+		in, out := &in.RequestHeadersToRemove, &out.RequestHeadersToRemove
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ResponseHeadersToAdd != nil {
+		in, out := &in.ResponseHeadersToAdd, &out.ResponseHeadersToAdd
+		*out = make([]ProPsyServiceHeaderValue, len(*in))
+		copy(*out, *in)
+	}
+	if in.ResponseHeadersToRemove != nil {
+		in, out := &in.ResponseHeadersToRemove, &out.ResponseHeadersToRemove
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceHeaders.
+func (in *ProPsyServiceHeaders) DeepCopy() *ProPsyServiceHeaders {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceHeaders)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceJWT) DeepCopyInto(out *ProPsyServiceJWT) {
+	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceJWT.
+func (in *ProPsyServiceJWT) DeepCopy() *ProPsyServiceJWT {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceJWT)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProPsyServiceList) DeepCopyInto(out *ProPsyServiceList) {
 	*out = *in
@@ -71,6 +341,138 @@ func (in *ProPsyServiceList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceLocalRateLimit) DeepCopyInto(out *ProPsyServiceLocalRateLimit) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceLocalRateLimit.
+func (in *ProPsyServiceLocalRateLimit) DeepCopy() *ProPsyServiceLocalRateLimit {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceLocalRateLimit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceMatch) DeepCopyInto(out *ProPsyServiceMatch) {
+	*out = *in
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make([]ProPsyServiceHeaderMatch, len(*in))
+		copy(*out, *in)
+	}
+	if in.QueryParameters != nil {
+		in, out := &in.QueryParameters, &out.QueryParameters
+		*out = make([]ProPsyServiceQueryParameterMatch, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceMatch.
+func (in *ProPsyServiceMatch) DeepCopy() *ProPsyServiceMatch {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceMatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceQueryParameterMatch) DeepCopyInto(out *ProPsyServiceQueryParameterMatch) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceQueryParameterMatch.
+func (in *ProPsyServiceQueryParameterMatch) DeepCopy() *ProPsyServiceQueryParameterMatch {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceQueryParameterMatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceRateLimitAction) DeepCopyInto(out *ProPsyServiceRateLimitAction) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceRateLimitAction.
+func (in *ProPsyServiceRateLimitAction) DeepCopy() *ProPsyServiceRateLimitAction {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceRateLimitAction)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceRateLimitDescriptor) DeepCopyInto(out *ProPsyServiceRateLimitDescriptor) {
+	*out = *in
+	if in.Actions != nil {
+		in, out := &in.Actions, &out.Actions
+		*out = make([]ProPsyServiceRateLimitAction, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceRateLimitDescriptor.
+func (in *ProPsyServiceRateLimitDescriptor) DeepCopy() *ProPsyServiceRateLimitDescriptor {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceRateLimitDescriptor)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceRedirect) DeepCopyInto(out *ProPsyServiceRedirect) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceRedirect.
+func (in *ProPsyServiceRedirect) DeepCopy() *ProPsyServiceRedirect {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceRedirect)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProPsyServiceRetryPolicy) DeepCopyInto(out *ProPsyServiceRetryPolicy) {
+	*out = *in
+	if in.RetriableStatusCodes != nil {
+		in, out := &in.RetriableStatusCodes, &out.RetriableStatusCodes
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProPsyServiceRetryPolicy.
+func (in *ProPsyServiceRetryPolicy) DeepCopy() *ProPsyServiceRetryPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ProPsyServiceRetryPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProPsyServiceSpec) DeepCopyInto(out *ProPsyServiceSpec) {
 	*out = *in
@@ -79,6 +481,42 @@ func (in *ProPsyServiceSpec) DeepCopyInto(out *ProPsyServiceSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	in.Match.DeepCopyInto(&out.Match)
+	if in.Domains != nil {
+		in, out := &in.Domains, &out.Domains
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ClientAllowedSANs != nil {
+		in, out := &in.ClientAllowedSANs, &out.ClientAllowedSANs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.RetryPolicy.DeepCopyInto(&out.RetryPolicy)
+	out.CircuitBreakers = in.CircuitBreakers
+	if in.HashPolicy != nil {
+		in, out := &in.HashPolicy, &out.HashPolicy
+		*out = make([]ProPsyServiceHashPolicy, len(*in))
+		copy(*out, *in)
+	}
+	in.FaultInjection.DeepCopyInto(&out.FaultInjection)
+	out.LocalRateLimit = in.LocalRateLimit
+	if in.RateLimitDescriptors != nil {
+		in, out := &in.RateLimitDescriptors, &out.RateLimitDescriptors
+		*out = make([]ProPsyServiceRateLimitDescriptor, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.ProPsyServiceHeaders.DeepCopyInto(&out.ProPsyServiceHeaders)
+	in.VHostHeaders.DeepCopyInto(&out.VHostHeaders)
+	out.Redirect = in.Redirect
+	out.DirectResponse = in.DirectResponse
+	in.Cors.DeepCopyInto(&out.Cors)
+	out.AccessLog = in.AccessLog
+	in.Compression.DeepCopyInto(&out.Compression)
+	out.ExtAuthz = in.ExtAuthz
+	in.JWT.DeepCopyInto(&out.JWT)
 	return
 }
 
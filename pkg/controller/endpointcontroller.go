@@ -130,7 +130,7 @@ func (C *EndpointController) EndpointChanged(old *v1.Endpoints, new *v1.Endpoint
 	C.EndpointAdded(new)                 // feed in new ones
 }
 
-func (C *EndpointController) ResyncEndpoints(namespace, service, canary string) {
+func (C *EndpointController) ResyncEndpoints(namespace, service, canary, mirror, authz string) {
 	endpoints, err := C.endpointGetter.Endpoints(namespace).Get(service, v12.GetOptions{})
 	if err == nil {
 		C.EndpointAdded(endpoints)
@@ -152,4 +152,18 @@ func (C *EndpointController) ResyncEndpoints(namespace, service, canary string)
 			C.EndpointAdded(endpointsCanary)
 		}
 	}
+
+	if mirror != "" {
+		endpointsMirror, err := C.endpointGetter.Endpoints(namespace).Get(mirror, v12.GetOptions{})
+		if err == nil {
+			C.EndpointAdded(endpointsMirror)
+		}
+	}
+
+	if authz != "" {
+		endpointsAuthz, err := C.endpointGetter.Endpoints(namespace).Get(authz, v12.GetOptions{})
+		if err == nil {
+			C.EndpointAdded(endpointsAuthz)
+		}
+	}
 }
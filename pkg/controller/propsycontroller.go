@@ -17,6 +17,8 @@ import (
 	listerv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -113,7 +115,8 @@ func (C *ProPsyController) SecretAdded(secret *v1.Secret) {
 		return
 	}
 	logrus.Debugf("Secret added: %s:%s", secret.Namespace, secret.Name)
-	C.ppsCache.UpdateTLS(secret.Namespace, secret.Name, secret.Data["tls.crt"], secret.Data["tls.key"])
+	C.ppsCache.UpdateTLS(secret.Namespace, secret.Name, secret.Data["tls.crt"], secret.Data["tls.key"], secret.Data["ca.crt"])
+	C.ppsCache.UpdateJWKS(secret.Namespace, secret.Name, secret.Data["jwks.json"])
 }
 
 func (C *ProPsyController) SecretRemoved(secret *v1.Secret) {
@@ -121,7 +124,8 @@ func (C *ProPsyController) SecretRemoved(secret *v1.Secret) {
 		return
 	}
 	logrus.Debugf("Secret removed: %s:%s", secret.Namespace, secret.Name)
-	C.ppsCache.UpdateTLS(secret.Namespace, secret.Name, []byte{}, []byte{})
+	C.ppsCache.UpdateTLS(secret.Namespace, secret.Name, []byte{}, []byte{}, []byte{})
+	C.ppsCache.UpdateJWKS(secret.Namespace, secret.Name, []byte{})
 }
 
 func (C *ProPsyController) SecretChanged(old, new *v1.Secret) {
@@ -185,6 +189,420 @@ func (C *ProPsyController) ExtractHealthCheck(pps *propsyv1.ProPsyService) (heal
 	return healthcheck, outlier
 }
 
+func (C *ProPsyController) ExtractUpstreamTLS(pps *propsyv1.ProPsyService) *propsy.UpstreamTLSConfig {
+	if !pps.Spec.UpstreamTLSEnabled {
+		return nil
+	}
+
+	upstreamTLS := &propsy.UpstreamTLSConfig{
+		SNI: pps.Spec.UpstreamTLSSNI,
+	}
+
+	// secrets are only watched in the local zone
+	if C.locality.Zone != propsy.LocalZone {
+		return upstreamTLS
+	}
+
+	if pps.Spec.UpstreamTLSCASecret != "" {
+		upstreamTLS.CA = C.ppsCache.GetOrCreateTLS(pps.Namespace, pps.Spec.UpstreamTLSCASecret)
+	}
+	if pps.Spec.UpstreamTLSCertificateSecret != "" {
+		upstreamTLS.Certificate = C.ppsCache.GetOrCreateTLS(pps.Namespace, pps.Spec.UpstreamTLSCertificateSecret)
+	}
+
+	return upstreamTLS
+}
+
+func extractCircuitBreakerThresholds(thresholds propsyv1.ProPsyServiceCircuitBreakerThresholds) *propsy.CircuitBreakerThresholds {
+	if thresholds == (propsyv1.ProPsyServiceCircuitBreakerThresholds{}) {
+		return nil
+	}
+
+	return &propsy.CircuitBreakerThresholds{
+		MaxConnections:     thresholds.MaxConnections,
+		MaxPendingRequests: thresholds.MaxPendingRequests,
+		MaxRequests:        thresholds.MaxRequests,
+		MaxRetries:         thresholds.MaxRetries,
+	}
+}
+
+func (C *ProPsyController) ExtractCircuitBreakers(pps *propsyv1.ProPsyService) *propsy.CircuitBreakersConfig {
+	circuitBreakers := &propsy.CircuitBreakersConfig{
+		Default: extractCircuitBreakerThresholds(pps.Spec.CircuitBreakers.Default),
+		High:    extractCircuitBreakerThresholds(pps.Spec.CircuitBreakers.High),
+	}
+
+	// the retry budget is part of the retry policy in the PPS, envoy keeps it with the thresholds of the cluster
+	if pps.Spec.RetryPolicy.RetryOn != "" && pps.Spec.RetryPolicy.BudgetPercent > 0 {
+		if circuitBreakers.Default == nil {
+			circuitBreakers.Default = &propsy.CircuitBreakerThresholds{}
+		}
+		circuitBreakers.Default.RetryBudgetPercent = pps.Spec.RetryPolicy.BudgetPercent
+		circuitBreakers.Default.MinRetryConcurrency = pps.Spec.RetryPolicy.MinRetryConcurrency
+	}
+
+	if circuitBreakers.Default == nil && circuitBreakers.High == nil {
+		return nil
+	}
+
+	return circuitBreakers
+}
+
+func (C *ProPsyController) ExtractHashPolicies(pps *propsyv1.ProPsyService) []*propsy.HashPolicyConfig {
+	var hashPolicies []*propsy.HashPolicyConfig
+	for i := range pps.Spec.HashPolicy {
+		hashPolicy := pps.Spec.HashPolicy[i]
+		hashPolicies = append(hashPolicies, &propsy.HashPolicyConfig{
+			Header:     hashPolicy.Header,
+			Cookie:     hashPolicy.Cookie,
+			CookieTTL:  time.Duration(hashPolicy.CookieTTL) * time.Millisecond,
+			CookiePath: hashPolicy.CookiePath,
+			SourceIP:   hashPolicy.SourceIP,
+			Terminal:   hashPolicy.Terminal,
+		})
+	}
+	return hashPolicies
+}
+
+func (C *ProPsyController) ExtractRetryPolicy(pps *propsyv1.ProPsyService) *propsy.RetryPolicyConfig {
+	if pps.Spec.RetryPolicy.RetryOn == "" {
+		return nil
+	}
+
+	retryOn := pps.Spec.RetryPolicy.RetryOn
+	// status codes are ignored by envoy unless asked for explicitly
+	if len(pps.Spec.RetryPolicy.RetriableStatusCodes) > 0 && !strings.Contains(retryOn, "retriable-status-codes") {
+		retryOn = retryOn + ",retriable-status-codes"
+	}
+
+	return &propsy.RetryPolicyConfig{
+		RetryOn:                  retryOn,
+		NumRetries:               pps.Spec.RetryPolicy.NumRetries,
+		PerTryTimeout:            time.Duration(pps.Spec.RetryPolicy.PerTryTimeout) * time.Millisecond,
+		RetriableStatusCodes:     pps.Spec.RetryPolicy.RetriableStatusCodes,
+		AvoidPreviousHosts:       pps.Spec.RetryPolicy.AvoidPreviousHosts,
+		HostSelectionMaxAttempts: pps.Spec.RetryPolicy.HostSelectionMaxAttempts,
+		BackOffBaseInterval:      time.Duration(pps.Spec.RetryPolicy.BackOffBaseInterval) * time.Millisecond,
+		BackOffMaxInterval:       time.Duration(pps.Spec.RetryPolicy.BackOffMaxInterval) * time.Millisecond,
+	}
+}
+
+func ExtractHeaderMatch(header propsyv1.ProPsyServiceHeaderMatch) *propsy.HeaderMatchConfig {
+	headerMatch := &propsy.HeaderMatchConfig{
+		Name:   header.Name,
+		Invert: header.Invert,
+	}
+
+	switch {
+	case header.Exact != "":
+		headerMatch.Type, headerMatch.Value = propsy.HeaderExactMatch, header.Exact
+	case header.Regex != "":
+		headerMatch.Type, headerMatch.Value = propsy.HeaderRegexMatch, header.Regex
+	case header.Prefix != "":
+		headerMatch.Type, headerMatch.Value = propsy.HeaderPrefixMatch, header.Prefix
+	case header.Suffix != "":
+		headerMatch.Type, headerMatch.Value = propsy.HeaderSuffixMatch, header.Suffix
+	default: // no value means we only care about the header being there
+		headerMatch.Type = propsy.HeaderPresentMatch
+	}
+
+	return headerMatch
+}
+
+func extractHeaderValues(headers []propsyv1.ProPsyServiceHeaderValue) []*propsy.HeaderValueConfig {
+	var values []*propsy.HeaderValueConfig
+	for i := range headers {
+		values = append(values, &propsy.HeaderValueConfig{
+			Name:   headers[i].Name,
+			Value:  headers[i].Value,
+			Append: headers[i].Append,
+		})
+	}
+	return values
+}
+
+func ExtractHeaders(headers propsyv1.ProPsyServiceHeaders) *propsy.HeadersConfig {
+	if len(headers.RequestHeadersToAdd) == 0 && len(headers.RequestHeadersToRemove) == 0 &&
+		len(headers.ResponseHeadersToAdd) == 0 && len(headers.ResponseHeadersToRemove) == 0 {
+		return nil
+	}
+
+	return &propsy.HeadersConfig{
+		RequestHeadersToAdd:     extractHeaderValues(headers.RequestHeadersToAdd),
+		RequestHeadersToRemove:  headers.RequestHeadersToRemove,
+		ResponseHeadersToAdd:    extractHeaderValues(headers.ResponseHeadersToAdd),
+		ResponseHeadersToRemove: headers.ResponseHeadersToRemove,
+	}
+}
+
+func (C *ProPsyController) ExtractRateLimitDescriptors(pps *propsyv1.ProPsyService) []*propsy.RateLimitDescriptorConfig {
+	if len(pps.Spec.RateLimitDescriptors) > 0 && propsy.RateLimitCluster == "" {
+		logrus.Warnf("Rate limit descriptors of %s/%s have no effect without a rate limit cluster", pps.Namespace, pps.Name)
+	}
+
+	var descriptors []*propsy.RateLimitDescriptorConfig
+	for d := range pps.Spec.RateLimitDescriptors {
+		descriptor := &propsy.RateLimitDescriptorConfig{}
+		for a := range pps.Spec.RateLimitDescriptors[d].Actions {
+			action := pps.Spec.RateLimitDescriptors[d].Actions[a]
+			descriptor.Actions = append(descriptor.Actions, &propsy.RateLimitActionConfig{
+				Header:        action.Header,
+				DescriptorKey: action.DescriptorKey,
+				RemoteAddress: action.RemoteAddress,
+				GenericKey:    action.GenericKey,
+			})
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors
+}
+
+func (C *ProPsyController) ExtractLocalRateLimit(pps *propsyv1.ProPsyService) *propsy.LocalRateLimitConfig {
+	if pps.Spec.LocalRateLimit.Requests <= 0 {
+		return nil
+	}
+
+	interval := time.Second
+	switch pps.Spec.LocalRateLimit.Unit {
+	case "second", "":
+	case "minute":
+		interval = time.Minute
+	case "hour":
+		interval = time.Hour
+	default:
+		logrus.Errorf("Unknown rate limit unit %s, using second", pps.Spec.LocalRateLimit.Unit)
+	}
+
+	return &propsy.LocalRateLimitConfig{
+		Requests:    pps.Spec.LocalRateLimit.Requests,
+		Interval:    interval,
+		Burst:       pps.Spec.LocalRateLimit.Burst,
+		PerListener: pps.Spec.LocalRateLimit.Scope == "listener",
+	}
+}
+
+func (C *ProPsyController) ExtractFaultInjection(pps *propsyv1.ProPsyService) *propsy.FaultInjectionConfig {
+	if pps.Spec.FaultInjection.Delay <= 0 && pps.Spec.FaultInjection.AbortStatus <= 0 {
+		return nil
+	}
+
+	fault := &propsy.FaultInjectionConfig{
+		DelayPercent: pps.Spec.FaultInjection.DelayPercent,
+		Delay:        time.Duration(pps.Spec.FaultInjection.Delay) * time.Millisecond,
+		AbortPercent: pps.Spec.FaultInjection.AbortPercent,
+		AbortStatus:  pps.Spec.FaultInjection.AbortStatus,
+	}
+
+	for i := range pps.Spec.FaultInjection.Headers {
+		fault.Headers = append(fault.Headers, ExtractHeaderMatch(pps.Spec.FaultInjection.Headers[i]))
+	}
+
+	return fault
+}
+
+func (C *ProPsyController) ExtractMatch(pps *propsyv1.ProPsyService) *propsy.MatchConfig {
+	match := &propsy.MatchConfig{
+		Path:  pps.Spec.Match.Path,
+		Regex: pps.Spec.Match.Regex,
+	}
+
+	if pps.Spec.Match.Method != "" {
+		match.Headers = append(match.Headers, &propsy.HeaderMatchConfig{
+			Name:  ":method",
+			Value: pps.Spec.Match.Method,
+			Type:  propsy.HeaderExactMatch,
+		})
+	}
+
+	for i := range pps.Spec.Match.Headers {
+		match.Headers = append(match.Headers, ExtractHeaderMatch(pps.Spec.Match.Headers[i]))
+	}
+
+	for i := range pps.Spec.Match.QueryParameters {
+		match.QueryParameters = append(match.QueryParameters, &propsy.QueryParameterMatchConfig{
+			Name:  pps.Spec.Match.QueryParameters[i].Name,
+			Value: pps.Spec.Match.QueryParameters[i].Value,
+			Regex: pps.Spec.Match.QueryParameters[i].Regex,
+		})
+	}
+
+	if match.IsEmpty() {
+		return nil
+	}
+
+	return match
+}
+
+// ExtractAccessLog overrides the daemon default with the fields set in the PPS
+func (C *ProPsyController) ExtractAccessLog(pps *propsyv1.ProPsyService) *propsy.AccessLogConfig {
+	if pps.Spec.AccessLog == (propsyv1.ProPsyServiceAccessLog{}) {
+		return nil
+	}
+
+	if pps.Spec.AccessLog.Disabled {
+		return &propsy.AccessLogConfig{Disabled: true}
+	}
+
+	accessLog := *propsy.DefaultAccessLog
+	if pps.Spec.AccessLog.Path != "" {
+		accessLog.Path = pps.Spec.AccessLog.Path
+	}
+	if pps.Spec.AccessLog.Cluster != "" {
+		accessLog.Cluster = pps.Spec.AccessLog.Cluster
+	}
+	if pps.Spec.AccessLog.Format != "" {
+		accessLog.Format = pps.Spec.AccessLog.Format
+	}
+	if pps.Spec.AccessLog.MinStatus > 0 {
+		accessLog.MinStatus = pps.Spec.AccessLog.MinStatus
+	}
+	if pps.Spec.AccessLog.SamplePercent > 0 {
+		accessLog.SamplePercent = pps.Spec.AccessLog.SamplePercent
+	}
+
+	return &accessLog
+}
+
+func (C *ProPsyController) ExtractExtAuthz(pps *propsyv1.ProPsyService) *propsy.ExtAuthzConfig {
+	if pps.Spec.ExtAuthz.Service == "" || GetProxyType(pps.Spec.Type) != propsy.HTTP {
+		return nil
+	}
+
+	grpc := true
+	switch pps.Spec.ExtAuthz.Protocol {
+	case "grpc", "":
+	case "http":
+		grpc = false
+	default:
+		logrus.Errorf("Unknown authorization protocol %s, using grpc", pps.Spec.ExtAuthz.Protocol)
+	}
+
+	timeout := 200 * time.Millisecond // envoy's default
+	if pps.Spec.ExtAuthz.Timeout > 0 {
+		timeout = time.Duration(pps.Spec.ExtAuthz.Timeout) * time.Millisecond
+	}
+
+	return &propsy.ExtAuthzConfig{
+		Service:          pps.Namespace + "/" + pps.Spec.ExtAuthz.Service,
+		GRPC:             grpc,
+		PathPrefix:       pps.Spec.ExtAuthz.PathPrefix,
+		Timeout:          timeout,
+		FailureModeAllow: pps.Spec.ExtAuthz.FailureModeAllow,
+	}
+}
+
+func (C *ProPsyController) ExtractJWT(pps *propsyv1.ProPsyService) *propsy.JWTConfig {
+	if pps.Spec.JWT.Issuer == "" || GetProxyType(pps.Spec.Type) != propsy.HTTP {
+		return nil
+	}
+
+	jwt := &propsy.JWTConfig{
+		Issuer:               pps.Spec.JWT.Issuer,
+		Audiences:            pps.Spec.JWT.Audiences,
+		RemoteJWKSURI:        pps.Spec.JWT.RemoteJWKSURI,
+		RemoteJWKSCluster:    pps.Spec.JWT.RemoteJWKSCluster,
+		Forward:              pps.Spec.JWT.Forward,
+		ForwardPayloadHeader: pps.Spec.JWT.ForwardPayloadHeader,
+	}
+
+	if jwt.RemoteJWKSURI == "" && pps.Spec.JWT.JWKSSecret != "" && C.locality.Zone == propsy.LocalZone {
+		jwt.JWKS = C.ppsCache.GetOrCreateTLS(pps.Namespace, pps.Spec.JWT.JWKSSecret)
+		C.ResyncTLS(pps.Namespace, pps.Spec.JWT.JWKSSecret)
+	}
+
+	return jwt
+}
+
+func GetCompressionLevel(levelInPps string) propsy.CompressionLevel {
+	switch levelInPps {
+	case "default", "":
+		return propsy.DefaultCompression
+	case "best":
+		return propsy.BestCompression
+	case "speed":
+		return propsy.FastestCompression
+	default:
+		logrus.Error("Unknown compression level " + levelInPps + ", using default")
+		return propsy.DefaultCompression
+	}
+}
+
+func (C *ProPsyController) ExtractCompression(pps *propsyv1.ProPsyService) *propsy.CompressionConfig {
+	if pps.Spec.Compression.Disabled {
+		return &propsy.CompressionConfig{Disabled: true}
+	}
+
+	if !pps.Spec.Compression.Enabled {
+		return nil
+	}
+
+	return &propsy.CompressionConfig{
+		ContentTypes: pps.Spec.Compression.ContentTypes,
+		MinLength:    pps.Spec.Compression.MinLength,
+		Level:        GetCompressionLevel(pps.Spec.Compression.Level),
+	}
+}
+
+func (C *ProPsyController) ExtractCors(pps *propsyv1.ProPsyService) *propsy.CorsConfig {
+	if len(pps.Spec.Cors.AllowOrigins) == 0 && len(pps.Spec.Cors.AllowOriginRegex) == 0 {
+		return nil
+	}
+
+	switch pps.Spec.Cors.Scope {
+	case "route", "vhost", "":
+	default:
+		logrus.Errorf("Unknown CORS scope %s, using route", pps.Spec.Cors.Scope)
+	}
+
+	return &propsy.CorsConfig{
+		AllowOrigins:     pps.Spec.Cors.AllowOrigins,
+		AllowOriginRegex: pps.Spec.Cors.AllowOriginRegex,
+		AllowMethods:     pps.Spec.Cors.AllowMethods,
+		AllowHeaders:     pps.Spec.Cors.AllowHeaders,
+		ExposeHeaders:    pps.Spec.Cors.ExposeHeaders,
+		MaxAge:           pps.Spec.Cors.MaxAge,
+		AllowCredentials: pps.Spec.Cors.AllowCredentials,
+		PerVHost:         pps.Spec.Cors.Scope == "vhost",
+	}
+}
+
+func (C *ProPsyController) ExtractRedirect(pps *propsyv1.ProPsyService) *propsy.RedirectConfig {
+	if pps.Spec.Type != "Redirect" {
+		return nil
+	}
+
+	return &propsy.RedirectConfig{
+		HTTPSRedirect: pps.Spec.Redirect.HTTPSRedirect,
+		Host:          pps.Spec.Redirect.Host,
+		Port:          pps.Spec.Redirect.Port,
+		Path:          pps.Spec.Redirect.Path,
+		PrefixRewrite: pps.Spec.PrefixRewrite,
+		ResponseCode:  pps.Spec.Redirect.ResponseCode,
+		StripQuery:    pps.Spec.Redirect.StripQuery,
+	}
+}
+
+func (C *ProPsyController) ExtractDirectResponse(pps *propsyv1.ProPsyService) *propsy.DirectResponseConfig {
+	if pps.Spec.Type != "DirectResponse" {
+		return nil
+	}
+
+	status := pps.Spec.DirectResponse.Status
+	if status == 0 {
+		status = 200
+	}
+
+	return &propsy.DirectResponseConfig{
+		Status: status,
+		Body:   pps.Spec.DirectResponse.Body,
+	}
+}
+
+// HasBackend tells whether the PPS routes to a service, redirects and direct responses have no endpoints at all
+func HasBackend(pps *propsyv1.ProPsyService) bool {
+	return pps.Spec.Type != "Redirect" && pps.Spec.Type != "DirectResponse"
+}
+
 func (C *ProPsyController) NewCluster(pps *propsyv1.ProPsyService, zone string, priority int, isCanary bool) *propsy.ClusterConfig {
 	var endpointName string
 	var percent int
@@ -205,16 +623,56 @@ func (C *ProPsyController) NewCluster(pps *propsyv1.ProPsyService, zone string,
 
 	healthcheck, outlier := C.ExtractHealthCheck(pps)
 
+	return &propsy.ClusterConfig{
+		ConnectTimeout:   pps.Spec.ConnectTimeout,
+		Name:             endpointName,
+		Weight:           percent,
+		EndpointConfig:   &endpointConfig,
+		IsCanary:         isCanary,
+		MaxRequests:      pps.Spec.MaxRequestsPerConnection,
+		Priority:         priority,
+		HealthCheck:      healthcheck,
+		Outlier:          outlier,
+		UpstreamTLS:      C.ExtractUpstreamTLS(pps),
+		CircuitBreakers:  C.ExtractCircuitBreakers(pps),
+		LBPolicy:         GetLBPolicy(pps.Spec.LBPolicy),
+		UpstreamProtocol: GetUpstreamProtocol(pps),
+		ProxyProtocol:    GetProxyProtocolVersion(pps),
+	}
+}
+
+// DefaultMirrorPercent is used when the PPS sets mirrorService alone
+const DefaultMirrorPercent = 100
+
+// NewMirrorCluster tracks the mirror service, all of the requests are mirrored unless the PPS sets mirrorPercent
+func (C *ProPsyController) NewMirrorCluster(pps *propsyv1.ProPsyService, zone string, priority int) *propsy.ClusterConfig {
+	cluster := C.NewCluster(pps, zone, priority, false)
+	cluster.Name = propsy.GenerateUniqueEndpointName(priority, pps.Namespace, pps.Spec.MirrorService)
+	cluster.EndpointConfig.Name = cluster.Name
+	cluster.Weight = pps.Spec.MirrorPercent
+	if cluster.Weight <= 0 {
+		cluster.Weight = DefaultMirrorPercent
+	}
+	cluster.IsMirror = true
+
+	return cluster
+}
+
+// NewAuthzCluster tracks the authorization service, it shares nothing but the connect timeout with the PPS backend
+func (C *ProPsyController) NewAuthzCluster(pps *propsyv1.ProPsyService, zone string, priority int) *propsy.ClusterConfig {
+	endpointName := propsy.GenerateUniqueEndpointName(priority, pps.Namespace, pps.Spec.ExtAuthz.Service)
+
 	return &propsy.ClusterConfig{
 		ConnectTimeout: pps.Spec.ConnectTimeout,
 		Name:           endpointName,
-		Weight:         percent,
-		EndpointConfig: &endpointConfig,
-		IsCanary:       isCanary,
-		MaxRequests:    pps.Spec.MaxRequestsPerConnection,
-		Priority:       priority,
-		HealthCheck:    healthcheck,
-		Outlier:        outlier,
+		EndpointConfig: &propsy.EndpointConfig{
+			Name:        endpointName,
+			ServicePort: pps.Spec.ExtAuthz.ServicePort,
+			Endpoints:   nil,
+			Locality:    &propsy.Locality{Zone: zone},
+		},
+		IsAuthz:  true,
+		Priority: priority,
 	}
 }
 
@@ -222,6 +680,10 @@ func (C *ProPsyController) NewRouteConfig(pps *propsyv1.ProPsyService) *propsy.R
 	var clusterConfigs []*propsy.ClusterConfig
 
 	for i := range C.endpointControllers {
+		if !HasBackend(pps) {
+			break
+		}
+
 		clusterConfig := C.NewCluster(pps, C.endpointControllers[i].Zone, C.endpointControllers[i].Priority, false)
 		clusterConfigCanary := C.NewCluster(pps, C.endpointControllers[i].Zone, C.endpointControllers[i].Priority, true)
 
@@ -229,27 +691,118 @@ func (C *ProPsyController) NewRouteConfig(pps *propsyv1.ProPsyService) *propsy.R
 		if pps.Spec.CanaryService != "" {
 			clusterConfigs = append(clusterConfigs, clusterConfigCanary)
 		}
+		if pps.Spec.MirrorService != "" && GetProxyType(pps.Spec.Type) == propsy.HTTP {
+			clusterConfigs = append(clusterConfigs, C.NewMirrorCluster(pps, C.endpointControllers[i].Zone, C.endpointControllers[i].Priority))
+		}
+		if pps.Spec.ExtAuthz.Service != "" && GetProxyType(pps.Spec.Type) == propsy.HTTP {
+			clusterConfigs = append(clusterConfigs, C.NewAuthzCluster(pps, C.endpointControllers[i].Zone, C.endpointControllers[i].Priority))
+		}
 	}
 
-	routeName, path := propsy.GenerateRouteName(pps.Spec.PathPrefix)
+	match := C.ExtractMatch(pps)
+	routeName, path := propsy.GenerateRouteName(pps.Spec.PathPrefix, match)
 
 	timeout := time.Duration(pps.Spec.Timeout) * time.Millisecond
 
 	return &propsy.RouteConfig{
-		Name:          routeName,
-		Clusters:      clusterConfigs,
-		PathPrefix:    path,
-		PrefixRewrite: pps.Spec.PrefixRewrite,
-		Timeout:       timeout,
+		Name:                 routeName,
+		Clusters:             clusterConfigs,
+		PathPrefix:           path,
+		PrefixRewrite:        pps.Spec.PrefixRewrite,
+		Timeout:              timeout,
+		Match:                match,
+		RetryPolicy:          C.ExtractRetryPolicy(pps),
+		HashPolicies:         C.ExtractHashPolicies(pps),
+		Fault:                C.ExtractFaultInjection(pps),
+		RateLimit:            C.ExtractLocalRateLimit(pps),
+		RateLimitDescriptors: C.ExtractRateLimitDescriptors(pps),
+		Headers:              ExtractHeaders(pps.Spec.ProPsyServiceHeaders),
+		VHostHeaders:         ExtractHeaders(pps.Spec.VHostHeaders),
+		Redirect:             C.ExtractRedirect(pps),
+		DirectResponse:       C.ExtractDirectResponse(pps),
+		Cors:                 C.ExtractCors(pps),
+		AccessLog:            C.ExtractAccessLog(pps),
+		Compression:          C.ExtractCompression(pps),
+		ExtAuthz:             C.ExtractExtAuthz(pps),
+		JWT:                  C.ExtractJWT(pps),
+		WebSocket:            pps.Spec.WebSocket && GetProxyType(pps.Spec.Type) == propsy.HTTP,
+		GRPC:                 pps.Spec.Type == "GRPC",
+		AcceptProxyProtocol:  pps.Spec.AcceptProxyProtocol,
+	}
+}
+
+func GetUpstreamProtocol(pps *propsyv1.ProPsyService) propsy.UpstreamProtocol {
+	if GetProxyType(pps.Spec.Type) != propsy.HTTP {
+		return propsy.HTTP1Upstream
+	}
+
+	if pps.Spec.Type == "GRPC" {
+		if pps.Spec.UpstreamProtocol != "" && pps.Spec.UpstreamProtocol != "HTTP2" {
+			logrus.Warnf("gRPC service %s/%s can only use HTTP2 upstream, ignoring %s", pps.Namespace, pps.Name, pps.Spec.UpstreamProtocol)
+		}
+		return propsy.HTTP2Upstream
+	}
+
+	switch pps.Spec.UpstreamProtocol {
+	case "HTTP1", "":
+		return propsy.HTTP1Upstream
+	case "HTTP2":
+		return propsy.HTTP2Upstream
+	case "auto":
+		return propsy.AutoUpstream
+	default:
+		logrus.Error("Unknown upstream protocol " + pps.Spec.UpstreamProtocol + ", using HTTP1")
+		return propsy.HTTP1Upstream
+	}
+}
+
+// GetProxyProtocolVersion returns the PROXY protocol version sent to the upstream, only TCP services can send it
+func GetProxyProtocolVersion(pps *propsyv1.ProPsyService) propsy.ProxyProtocolVersion {
+	if pps.Spec.UpstreamProxyProtocol == "" {
+		return propsy.NoProxyProtocol
+	}
+	if GetProxyType(pps.Spec.Type) != propsy.TCP {
+		logrus.Warnf("Only TCP services can send the PROXY protocol, ignoring it for %s/%s", pps.Namespace, pps.Name)
+		return propsy.NoProxyProtocol
+	}
+
+	switch pps.Spec.UpstreamProxyProtocol {
+	case "v1":
+		return propsy.ProxyProtocolV1
+	case "v2":
+		return propsy.ProxyProtocolV2
+	default:
+		logrus.Error("Unknown PROXY protocol version " + pps.Spec.UpstreamProxyProtocol + ", not sending it")
+		return propsy.NoProxyProtocol
+	}
+}
+
+func GetLBPolicy(lbPolicyInPps string) propsy.LBPolicy {
+	switch lbPolicyInPps {
+	case "ROUND_ROBIN", "":
+		return propsy.RoundRobinLB
+	case "LEAST_REQUEST":
+		return propsy.LeastRequestLB
+	case "RING_HASH":
+		return propsy.RingHashLB
+	case "RANDOM":
+		return propsy.RandomLB
+	case "MAGLEV":
+		return propsy.MaglevLB
+	default:
+		logrus.Error("Unknown lb policy " + lbPolicyInPps + ", using round robin")
+		return propsy.RoundRobinLB
 	}
 }
 
 func GetProxyType(typeInPps string) propsy.ProxyType {
 	switch typeInPps {
-	case "HTTP":
+	case "HTTP", "GRPC", "Redirect", "DirectResponse":
 		return propsy.HTTP
 	case "TCP":
 		return propsy.TCP
+	case "UDP":
+		return propsy.UDP
 	case "":
 		return propsy.HTTP
 	default:
@@ -258,39 +811,65 @@ func GetProxyType(typeInPps string) propsy.ProxyType {
 	}
 }
 
+// GetDomains returns the domains of the vhost the PPS belongs to, sorted so the vhost name is stable. TCP services
+// are told apart by SNI, so the domains are the server names there.
+func GetDomains(pps *propsyv1.ProPsyService, propsyType propsy.ProxyType) []string {
+	if len(pps.Spec.Domains) == 0 || propsyType == propsy.UDP {
+		return []string{"*"}
+	}
+
+	domains := make([]string, len(pps.Spec.Domains))
+	copy(domains, pps.Spec.Domains)
+	sort.Strings(domains)
+
+	return domains
+}
+
 func (C *ProPsyController) NewListenerConfig(pps *propsyv1.ProPsyService) *propsy.ListenerConfig {
 	propsyType := GetProxyType(pps.Spec.Type)
 	if propsyType == -1 {
 		return nil
 	}
 
-	domains := []string{"*"} // TODO ?
+	domains := GetDomains(pps, propsyType)
 	vhostName := propsy.GenerateVHostName(domains)
 	listenerName := propsy.GenerateListenerName(pps.Spec.Listen, propsyType)
 
 	var tlsData *propsy.TlsData = nil
-	if pps.Spec.TLSCertificateSecret != "" && C.locality.Zone == propsy.LocalZone && (pps.Spec.PathPrefix == "" || pps.Spec.PathPrefix == "/") {
+	if pps.Spec.TLSCertificateSecret != "" && C.locality.Zone == propsy.LocalZone {
 		tlsData = C.ppsCache.GetOrCreateTLS(pps.Namespace, pps.Spec.TLSCertificateSecret)
 		C.ResyncTLS(pps.Namespace, pps.Spec.TLSCertificateSecret)
 	}
 
+	var clientCA *propsy.TlsData = nil
+	if tlsData != nil && pps.Spec.ClientCASecret != "" {
+		clientCA = C.ppsCache.GetOrCreateTLS(pps.Namespace, pps.Spec.ClientCASecret)
+		C.ResyncTLS(pps.Namespace, pps.Spec.ClientCASecret)
+	}
+
 	return &propsy.ListenerConfig{
 		Name:   listenerName,
 		Listen: pps.Spec.Listen,
 		VirtualHosts: []*propsy.VirtualHost{{
-			Name:    vhostName,
-			Domains: domains,
-			Routes:  []*propsy.RouteConfig{C.NewRouteConfig(pps)},
+			Name:              vhostName,
+			Domains:           domains,
+			Routes:            []*propsy.RouteConfig{C.NewRouteConfig(pps)},
+			TLSSecret:         tlsData,
+			ClientCA:          clientCA,
+			ClientAllowedSANs: pps.Spec.ClientAllowedSANs,
 		}},
 		Type:            propsyType,
 		TrackedLocality: []string{C.locality.Zone},
-		TLSSecret:       tlsData,
 	}
 }
 
 func (C *ProPsyController) ResyncEndpoints(pps *propsyv1.ProPsyService) {
+	if !HasBackend(pps) {
+		return
+	}
+
 	for ctrl := range C.endpointControllers {
-		C.endpointControllers[ctrl].ResyncEndpoints(pps.Namespace, pps.Spec.Service, pps.Spec.CanaryService)
+		C.endpointControllers[ctrl].ResyncEndpoints(pps.Namespace, pps.Spec.Service, pps.Spec.CanaryService, pps.Spec.MirrorService, pps.Spec.ExtAuthz.Service)
 	}
 }
 
@@ -322,6 +901,27 @@ func (C *ProPsyController) PPSAdded(pps *propsyv1.ProPsyService) {
 		if pps.Spec.TLSCertificateSecret != "" {
 			C.ppsCache.AddTLSWatch(pps.Namespace, pps.Spec.TLSCertificateSecret, nodes[node])
 		}
+		if pps.Spec.TLSCertificateSecret != "" && pps.Spec.ClientCASecret != "" {
+			C.ppsCache.AddTLSWatch(pps.Namespace, pps.Spec.ClientCASecret, nodes[node])
+		}
+		if pps.Spec.UpstreamTLSEnabled && pps.Spec.UpstreamTLSCASecret != "" {
+			C.ppsCache.AddTLSWatch(pps.Namespace, pps.Spec.UpstreamTLSCASecret, nodes[node])
+		}
+		if pps.Spec.UpstreamTLSEnabled && pps.Spec.UpstreamTLSCertificateSecret != "" {
+			C.ppsCache.AddTLSWatch(pps.Namespace, pps.Spec.UpstreamTLSCertificateSecret, nodes[node])
+		}
+		if pps.Spec.JWT.Issuer != "" && pps.Spec.JWT.RemoteJWKSURI == "" && pps.Spec.JWT.JWKSSecret != "" {
+			C.ppsCache.AddTLSWatch(pps.Namespace, pps.Spec.JWT.JWKSSecret, nodes[node])
+		}
+	}
+
+	if pps.Spec.UpstreamTLSEnabled && C.locality.Zone == propsy.LocalZone {
+		if pps.Spec.UpstreamTLSCASecret != "" {
+			C.ResyncTLS(pps.Namespace, pps.Spec.UpstreamTLSCASecret)
+		}
+		if pps.Spec.UpstreamTLSCertificateSecret != "" {
+			C.ResyncTLS(pps.Namespace, pps.Spec.UpstreamTLSCertificateSecret)
+		}
 	}
 
 	C.ResyncEndpoints(pps)
@@ -338,10 +938,10 @@ func (C *ProPsyController) PPSAdded(pps *propsyv1.ProPsyService) {
 
 func (C *ProPsyController) PPSRemoved(pps *propsyv1.ProPsyService, isUpdate bool) {
 	propsyType := GetProxyType(pps.Spec.Type)
-	domains := []string{"*"}
+	domains := GetDomains(pps, propsyType)
 	vhostName := propsy.GenerateVHostName(domains)
 	listenerName := propsy.GenerateListenerName(pps.Spec.Listen, propsyType)
-	routeName, _ := propsy.GenerateRouteName(pps.Spec.PathPrefix)
+	routeName, _ := propsy.GenerateRouteName(pps.Spec.PathPrefix, C.ExtractMatch(pps))
 
 	for i := range pps.Spec.Nodes {
 		node := C.ppsCache.GetOrCreateNode(pps.Spec.Nodes[i])
@@ -360,6 +960,12 @@ func (C *ProPsyController) PPSRemoved(pps *propsyv1.ProPsyService, isUpdate bool
 				if pps.Spec.CanaryService != "" {
 					lis.SafeRemove(vhostName, routeName, propsy.GenerateUniqueEndpointName(C.endpointControllers[ec].Priority, pps.Namespace, pps.Spec.CanaryService), C.locality.Zone)
 				}
+				if pps.Spec.MirrorService != "" {
+					lis.SafeRemove(vhostName, routeName, propsy.GenerateUniqueEndpointName(C.endpointControllers[ec].Priority, pps.Namespace, pps.Spec.MirrorService), C.locality.Zone)
+				}
+				if pps.Spec.ExtAuthz.Service != "" {
+					lis.SafeRemove(vhostName, routeName, propsy.GenerateUniqueEndpointName(C.endpointControllers[ec].Priority, pps.Namespace, pps.Spec.ExtAuthz.Service), C.locality.Zone)
+				}
 				lis.SafeRemove(vhostName, routeName, propsy.GenerateUniqueEndpointName(C.endpointControllers[ec].Priority, pps.Namespace, pps.Spec.Service), C.locality.Zone)
 
 				logrus.Debugf("Remaining vhosts: %d", len(lis.VirtualHosts))
@@ -395,7 +1001,8 @@ func (C *ProPsyController) PPSChanged(old *propsyv1.ProPsyService, new *propsyv1
 
 	for i := range new.Spec.Nodes {
 		C.ppsCache.GetOrCreateNode(new.Spec.Nodes[i]).Update()
-		if old.Spec.Service != new.Spec.Service || old.Spec.CanaryService != new.Spec.CanaryService {
+		if old.Spec.Service != new.Spec.Service || old.Spec.CanaryService != new.Spec.CanaryService || old.Spec.MirrorService != new.Spec.MirrorService ||
+			old.Spec.ExtAuthz.Service != new.Spec.ExtAuthz.Service {
 			C.ResyncEndpoints(new)
 		}
 	}
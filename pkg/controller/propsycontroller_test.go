@@ -4,6 +4,7 @@ import (
 	"github.com/seznam/ProPsy/pkg/apis/propsy/v1"
 	"github.com/seznam/ProPsy/pkg/propsy"
 	"github.com/seznam/ProPsy/pkg/testutils"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"log"
 	"reflect"
 	"testing"
@@ -56,7 +57,6 @@ func Test_NewListenerConfig(t *testing.T) {
 	}
 
 	properListener := propsy.ListenerConfig{
-		TLSSecret:       nil,
 		TrackedLocality: []string{"left"},
 		Type:            propsy.HTTP,
 		Name:            "127.0.0.1-1234_0",
@@ -76,9 +76,9 @@ func Test_NewListenerConfig(t *testing.T) {
 
 	listener := controller1.NewListenerConfig(&pps)
 
-	if !reflect.DeepEqual(*listener, properListener) {
+	if !reflect.DeepEqual(listener, &properListener) {
 		log.Println("Checked func NewListenerConfig:\n======")
-		log.Fatalf("Listeners are not correct:\nGenerated:\n%+v\n== vs ==\nExpected:\n%+v", *listener, properListener)
+		log.Fatalf("Listeners are not correct:\nGenerated:\n%+v\n== vs ==\nExpected:\n%+v", listener, &properListener)
 		log.Println("=====")
 	}
 
@@ -86,6 +86,10 @@ func Test_NewListenerConfig(t *testing.T) {
 	if xpps := controller1.NewListenerConfig(&pps); xpps == nil || xpps.Type != propsy.TCP {
 		log.Fatalf("Error decoding TCP type service")
 	}
+	pps.Spec.Type = "UDP"
+	if xpps := controller1.NewListenerConfig(&pps); xpps == nil || xpps.Type != propsy.UDP {
+		log.Fatalf("Error decoding UDP type service")
+	}
 	pps.Spec.Type = ""
 	if xpps := controller1.NewListenerConfig(&pps); xpps == nil || xpps.Type != propsy.HTTP {
 		log.Fatalf("Error decoding TCP type service")
@@ -202,3 +206,569 @@ func Test_PriorityTrackers(t *testing.T) {
 	// TODO no way to reset it to the other locality's before update comes
 	testutils.AssertString(ppsCache.GetNodes()["node-a"].Listeners[0].Listen, "127.0.0.1:4334")
 }
+
+func Test_ExtractMatch(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			PathPrefix: "/foobar/",
+		},
+	}
+
+	if controller1.ExtractMatch(&pps) != nil {
+		log.Fatalf("Empty match section should not generate a match")
+	}
+
+	pps.Spec.Match = v1.ProPsyServiceMatch{
+		Path:   "/foobar/exact",
+		Method: "POST",
+		Headers: []v1.ProPsyServiceHeaderMatch{
+			{Name: "x-canary", Exact: "1"},
+			{Name: "x-debug"},
+		},
+		QueryParameters: []v1.ProPsyServiceQueryParameterMatch{
+			{Name: "debug"},
+		},
+	}
+
+	match := controller1.ExtractMatch(&pps)
+	testutils.AssertString(match.Path, "/foobar/exact")
+	testutils.AssertInt(len(match.Headers), 3)
+	testutils.AssertString(match.Headers[0].Name, ":method")
+	testutils.AssertString(match.Headers[0].Value, "POST")
+	testutils.AssertString(match.Headers[1].Value, "1")
+	if match.Headers[2].Type != propsy.HeaderPresentMatch {
+		log.Fatalf("Header without a value should be a presence match")
+	}
+	testutils.AssertInt(len(match.QueryParameters), 1)
+
+	route := controller1.NewRouteConfig(&pps)
+	routeName, _ := propsy.GenerateRouteName(pps.Spec.PathPrefix, match)
+	testutils.AssertString(route.Name, routeName)
+	testutils.AssertString(route.PathPrefix, "/foobar/")
+}
+
+func Test_Domains(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			Timeout:    10,
+			PathPrefix: "/",
+			Service:    "SomeService",
+			Nodes: []string{
+				"node-domains",
+			},
+			Listen:      "127.0.0.1:2345",
+			Type:        "HTTP",
+			ServicePort: 6010,
+			Percent:     100,
+			Domains:     []string{"www.example.cz", "api.example.cz"},
+		},
+	}
+	pps2 := *pps.DeepCopy()
+	pps2.Spec.Domains = nil
+
+	testutils.AssertString(GetDomains(&pps, propsy.UDP)[0], "*")
+	testutils.AssertString(GetDomains(&pps, propsy.TCP)[0], "api.example.cz") // used for SNI
+	listener := controller1.NewListenerConfig(&pps)
+	testutils.AssertString(listener.VirtualHosts[0].Name, "api.example.cz-www.example.cz")
+
+	controller1.PPSAdded(&pps)
+	controller1.PPSAdded(&pps2)
+	node := ppsCache.GetOrCreateNode("node-domains")
+	testutils.AssertInt(len(node.Listeners), 1)
+	testutils.AssertInt(len(node.Listeners[0].VirtualHosts), 2)
+
+	controller1.PPSRemoved(&pps, false)
+	testutils.AssertInt(len(node.Listeners[0].VirtualHosts), 1)
+	testutils.AssertString(node.Listeners[0].VirtualHosts[0].Name, "*")
+
+	controller1.PPSRemoved(&pps2, false)
+	testutils.AssertInt(len(node.Listeners), 0)
+}
+
+func Test_ExtractUpstreamTLS(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			Service:                      "SomeService",
+			UpstreamTLSSNI:               "backend.example.cz",
+			UpstreamTLSCASecret:          "backend-ca",
+			UpstreamTLSCertificateSecret: "backend-client",
+		},
+	}
+	pps.Namespace = "upstream"
+
+	if controller1.ExtractUpstreamTLS(&pps) != nil {
+		log.Fatalf("Upstream TLS should be disabled by default")
+	}
+
+	pps.Spec.UpstreamTLSEnabled = true
+	upstreamTLS := controller1.ExtractUpstreamTLS(&pps)
+	testutils.AssertString(upstreamTLS.SNI, "backend.example.cz")
+	if upstreamTLS.CA != ppsCache.GetTls("upstream", "backend-ca") || upstreamTLS.Certificate != ppsCache.GetTls("upstream", "backend-client") {
+		log.Fatalf("Upstream TLS secrets are not shared with the cache")
+	}
+
+	upstreamTLS = controller2.ExtractUpstreamTLS(&pps)
+	if upstreamTLS.CA != nil || upstreamTLS.Certificate != nil {
+		log.Fatalf("Upstream TLS secrets should only be used in the local zone")
+	}
+}
+
+func Test_ExtractRetryPolicy(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			RetryPolicy: v1.ProPsyServiceRetryPolicy{
+				NumRetries: 2,
+			},
+		},
+	}
+
+	if controller1.ExtractRetryPolicy(&pps) != nil {
+		log.Fatalf("Retry policy should not be generated without retryOn")
+	}
+
+	pps.Spec.RetryPolicy.RetryOn = "5xx"
+	pps.Spec.RetryPolicy.PerTryTimeout = 300
+	pps.Spec.RetryPolicy.RetriableStatusCodes = []int{503}
+	pps.Spec.RetryPolicy.AvoidPreviousHosts = true
+	retryPolicy := controller1.ExtractRetryPolicy(&pps)
+	testutils.AssertString(retryPolicy.RetryOn, "5xx,retriable-status-codes")
+	testutils.AssertInt(retryPolicy.NumRetries, 2)
+	testutils.AssertInt64(int64(retryPolicy.PerTryTimeout), int64(300*time.Millisecond))
+	if !retryPolicy.AvoidPreviousHosts || !reflect.DeepEqual(retryPolicy.RetriableStatusCodes, []int{503}) {
+		log.Fatalf("Retry policy was not extracted properly: %+v", retryPolicy)
+	}
+
+	pps.Spec.RetryPolicy.RetryOn = "retriable-status-codes,reset"
+	testutils.AssertString(controller1.ExtractRetryPolicy(&pps).RetryOn, "retriable-status-codes,reset")
+}
+
+func Test_ExtractCircuitBreakers(t *testing.T) {
+	pps := v1.ProPsyService{}
+
+	if controller1.ExtractCircuitBreakers(&pps) != nil {
+		log.Fatalf("Circuit breakers should be left to envoy defaults when not set")
+	}
+
+	pps.Spec.CircuitBreakers.High.MaxRequests = 4096
+	circuitBreakers := controller1.ExtractCircuitBreakers(&pps)
+	if circuitBreakers.Default != nil {
+		log.Fatalf("Default priority thresholds should not be set")
+	}
+	testutils.AssertInt(circuitBreakers.High.MaxRequests, 4096)
+	testutils.AssertInt(circuitBreakers.High.MaxConnections, 0)
+
+	if controller1.NewCluster(&pps, "left", 0, false).CircuitBreakers.High.MaxRequests != 4096 {
+		log.Fatalf("Circuit breakers are not set on the cluster")
+	}
+
+	// the retry budget of the retry policy goes to the default priority thresholds
+	pps.Spec.RetryPolicy.BudgetPercent = 20
+	if controller1.ExtractCircuitBreakers(&pps).Default != nil {
+		log.Fatalf("Retry budget should be ignored without retryOn")
+	}
+	pps.Spec.RetryPolicy.RetryOn = "5xx"
+	pps.Spec.RetryPolicy.MinRetryConcurrency = 5
+	circuitBreakers = controller1.ExtractCircuitBreakers(&pps)
+	testutils.AssertInt(circuitBreakers.Default.RetryBudgetPercent, 20)
+	testutils.AssertInt(circuitBreakers.Default.MinRetryConcurrency, 5)
+	testutils.AssertInt(circuitBreakers.Default.MaxRetries, 0)
+}
+
+func Test_LBPolicy(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			LBPolicy: "RING_HASH",
+			HashPolicy: []v1.ProPsyServiceHashPolicy{
+				{Header: "x-user-id"},
+				{SourceIP: true, Terminal: true},
+			},
+		},
+	}
+
+	if controller1.NewCluster(&pps, "left", 0, false).LBPolicy != propsy.RingHashLB {
+		log.Fatalf("LB policy was not set on the cluster")
+	}
+	if GetLBPolicy("") != propsy.RoundRobinLB || GetLBPolicy("unknown") != propsy.RoundRobinLB {
+		log.Fatalf("Round robin should be used by default")
+	}
+
+	hashPolicies := controller1.ExtractHashPolicies(&pps)
+	testutils.AssertInt(len(hashPolicies), 2)
+	testutils.AssertString(hashPolicies[0].Header, "x-user-id")
+	if !hashPolicies[1].SourceIP || !hashPolicies[1].Terminal {
+		log.Fatalf("Hash policy was not extracted properly: %+v", hashPolicies[1])
+	}
+}
+
+func Test_NewMirrorCluster(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			Service:       "SomeService",
+			MirrorService: "ShadowService",
+			MirrorPercent: 25,
+			Percent:       100,
+		},
+	}
+	pps.Namespace = "mirror"
+
+	mirror := controller1.NewMirrorCluster(&pps, "left", 0)
+	testutils.AssertString(mirror.Name, "0-mirror-ShadowService")
+	testutils.AssertString(mirror.EndpointConfig.Name, "0-mirror-ShadowService")
+	testutils.AssertInt(mirror.Weight, 25)
+	if !mirror.IsMirror || mirror.IsCanary {
+		log.Fatalf("Mirror cluster is not marked properly: %+v", mirror)
+	}
+
+	// a mirror without a percentage gets all of the requests rather than none
+	pps.Spec.MirrorPercent = 0
+	testutils.AssertInt(controller1.NewMirrorCluster(&pps, "left", 0).Weight, 100)
+}
+
+func Test_ExtractFaultInjection(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			FaultInjection: v1.ProPsyServiceFaultInjection{
+				DelayPercent: 50,
+			},
+		},
+	}
+
+	if controller1.ExtractFaultInjection(&pps) != nil {
+		log.Fatalf("Fault injection should not be set up without a delay or abort")
+	}
+
+	pps.Spec.FaultInjection.Delay = 1500
+	pps.Spec.FaultInjection.Headers = []v1.ProPsyServiceHeaderMatch{{Name: "x-chaos", Exact: "yes"}}
+	fault := controller1.ExtractFaultInjection(&pps)
+	testutils.AssertInt64(int64(fault.Delay), int64(1500*time.Millisecond))
+	testutils.AssertInt(fault.DelayPercent, 50)
+	testutils.AssertInt(fault.AbortStatus, 0)
+	testutils.AssertInt(len(fault.Headers), 1)
+	testutils.AssertString(fault.Headers[0].Value, "yes")
+	if fault.Headers[0].Type != propsy.HeaderExactMatch {
+		log.Fatalf("Fault injection header gate was not extracted properly")
+	}
+}
+
+func Test_ExtractLocalRateLimit(t *testing.T) {
+	pps := v1.ProPsyService{}
+
+	if controller1.ExtractLocalRateLimit(&pps) != nil {
+		log.Fatalf("Rate limit should not be set up without requests")
+	}
+
+	pps.Spec.LocalRateLimit = v1.ProPsyServiceLocalRateLimit{Requests: 600, Unit: "minute", Burst: 50, Scope: "listener"}
+	rateLimit := controller1.ExtractLocalRateLimit(&pps)
+	testutils.AssertInt(rateLimit.Requests, 600)
+	testutils.AssertInt(rateLimit.Burst, 50)
+	testutils.AssertInt64(int64(rateLimit.Interval), int64(time.Minute))
+	if !rateLimit.PerListener {
+		log.Fatalf("Rate limit should be shared by the listener")
+	}
+
+	pps.Spec.LocalRateLimit.Unit = ""
+	pps.Spec.LocalRateLimit.Scope = "route"
+	rateLimit = controller1.ExtractLocalRateLimit(&pps)
+	testutils.AssertInt64(int64(rateLimit.Interval), int64(time.Second))
+	if rateLimit.PerListener {
+		log.Fatalf("Rate limit should be per route")
+	}
+}
+
+func Test_ExtractRateLimitDescriptors(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			RateLimitDescriptors: []v1.ProPsyServiceRateLimitDescriptor{{
+				Actions: []v1.ProPsyServiceRateLimitAction{
+					{GenericKey: "search"},
+					{Header: "x-user", DescriptorKey: "user"},
+				},
+			}},
+		},
+	}
+
+	descriptors := controller1.ExtractRateLimitDescriptors(&pps)
+	testutils.AssertInt(len(descriptors), 1)
+	testutils.AssertInt(len(descriptors[0].Actions), 2)
+	testutils.AssertString(descriptors[0].Actions[0].GenericKey, "search")
+	testutils.AssertString(descriptors[0].Actions[1].Header, "x-user")
+	testutils.AssertString(descriptors[0].Actions[1].DescriptorKey, "user")
+}
+
+func Test_ExtractHeaders(t *testing.T) {
+	if ExtractHeaders(v1.ProPsyServiceHeaders{}) != nil {
+		log.Fatalf("Headers should not be set up when empty")
+	}
+
+	headers := ExtractHeaders(v1.ProPsyServiceHeaders{
+		RequestHeadersToAdd:    []v1.ProPsyServiceHeaderValue{{Name: "x-client", Value: "%DOWNSTREAM_REMOTE_ADDRESS%", Append: true}},
+		RequestHeadersToRemove: []string{"cookie"},
+	})
+	testutils.AssertInt(len(headers.RequestHeadersToAdd), 1)
+	testutils.AssertString(headers.RequestHeadersToAdd[0].Name, "x-client")
+	testutils.AssertString(headers.RequestHeadersToAdd[0].Value, "%DOWNSTREAM_REMOTE_ADDRESS%")
+	if !headers.RequestHeadersToAdd[0].Append {
+		log.Fatalf("Header should be appended")
+	}
+	testutils.AssertInt(len(headers.RequestHeadersToRemove), 1)
+	testutils.AssertInt(len(headers.ResponseHeadersToAdd), 0)
+}
+
+func Test_Redirect(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			Type:          "Redirect",
+			Listen:        "0.0.0.0:80",
+			PrefixRewrite: "/new",
+			Redirect:      v1.ProPsyServiceRedirect{HTTPSRedirect: true, ResponseCode: 302},
+		},
+	}
+
+	if HasBackend(&pps) {
+		log.Fatalf("Redirect should have no backend")
+	}
+	if GetProxyType(pps.Spec.Type) != propsy.HTTP {
+		log.Fatalf("Redirect should be served by an HTTP listener")
+	}
+
+	routeConfig := controller1.NewRouteConfig(&pps)
+	testutils.AssertInt(len(routeConfig.Clusters), 0)
+	if routeConfig.Redirect == nil || !routeConfig.Redirect.HTTPSRedirect {
+		log.Fatalf("Redirect should be set up")
+	}
+	testutils.AssertInt(routeConfig.Redirect.ResponseCode, 302)
+	testutils.AssertString(routeConfig.Redirect.PrefixRewrite, "/new")
+	if routeConfig.DirectResponse != nil {
+		log.Fatalf("Direct response should not be set up")
+	}
+}
+
+func Test_DirectResponse(t *testing.T) {
+	pps := v1.ProPsyService{Spec: v1.ProPsyServiceSpec{Type: "DirectResponse", DirectResponse: v1.ProPsyServiceDirectResponse{Body: "OK"}}}
+
+	directResponse := controller1.ExtractDirectResponse(&pps)
+	testutils.AssertInt(directResponse.Status, 200)
+	testutils.AssertString(directResponse.Body, "OK")
+	if controller1.ExtractRedirect(&pps) != nil {
+		log.Fatalf("Redirect should not be set up")
+	}
+
+	pps.Spec.Type = "HTTP"
+	if !HasBackend(&pps) || controller1.ExtractDirectResponse(&pps) != nil {
+		log.Fatalf("HTTP service should route to its backend")
+	}
+}
+
+func Test_ExtractCors(t *testing.T) {
+	pps := v1.ProPsyService{}
+
+	if controller1.ExtractCors(&pps) != nil {
+		log.Fatalf("CORS should not be set up without origins")
+	}
+
+	pps.Spec.Cors = v1.ProPsyServiceCors{AllowOriginRegex: []string{".*"}, AllowHeaders: []string{"authorization"}, MaxAge: 60, Scope: "vhost"}
+	cors := controller1.ExtractCors(&pps)
+	testutils.AssertInt(len(cors.AllowOriginRegex), 1)
+	testutils.AssertString(cors.AllowHeaders[0], "authorization")
+	testutils.AssertInt(cors.MaxAge, 60)
+	if !cors.PerVHost {
+		log.Fatalf("CORS should be shared by the vhost")
+	}
+
+	pps.Spec.Cors.Scope = ""
+	if controller1.ExtractCors(&pps).PerVHost {
+		log.Fatalf("CORS should be per route")
+	}
+}
+
+func Test_ExtractAccessLog(t *testing.T) {
+	pps := v1.ProPsyService{}
+
+	if controller1.ExtractAccessLog(&pps) != nil {
+		log.Fatalf("Access log should fall back to the default")
+	}
+
+	propsy.DefaultAccessLog = &propsy.AccessLogConfig{Path: "/dev/stdout", Format: "%START_TIME%"}
+	defer func() { propsy.DefaultAccessLog = &propsy.AccessLogConfig{} }()
+
+	pps.Spec.AccessLog = v1.ProPsyServiceAccessLog{MinStatus: 500}
+	accessLog := controller1.ExtractAccessLog(&pps)
+	testutils.AssertString(accessLog.Path, "/dev/stdout")
+	testutils.AssertString(accessLog.Format, "%START_TIME%")
+	testutils.AssertInt(accessLog.MinStatus, 500)
+
+	pps.Spec.AccessLog.Disabled = true
+	if controller1.ExtractAccessLog(&pps).IsEnabled() {
+		log.Fatalf("Access log should be disabled")
+	}
+}
+
+func Test_ExtractCompression(t *testing.T) {
+	pps := v1.ProPsyService{}
+
+	if controller1.ExtractCompression(&pps) != nil {
+		log.Fatalf("Compression should not be set up unless enabled")
+	}
+
+	pps.Spec.Compression = v1.ProPsyServiceCompression{Enabled: true, ContentTypes: []string{"text/css"}, MinLength: 100, Level: "speed"}
+	compression := controller1.ExtractCompression(&pps)
+	testutils.AssertString(compression.ContentTypes[0], "text/css")
+	testutils.AssertInt(compression.MinLength, 100)
+	if compression.Level != propsy.FastestCompression || compression.Disabled {
+		log.Fatalf("Wrong compression: %+v", compression)
+	}
+
+	pps.Spec.Compression.Disabled = true
+	if !controller1.ExtractCompression(&pps).Disabled {
+		log.Fatalf("Compression should be disabled")
+	}
+}
+
+func Test_ExtAuthz(t *testing.T) {
+	pps := v1.ProPsyService{
+		ObjectMeta: v12.ObjectMeta{Namespace: "ns"},
+		Spec: v1.ProPsyServiceSpec{
+			Service:        "app",
+			ConnectTimeout: 500,
+			ExtAuthz:       v1.ProPsyServiceExtAuthz{Service: "sso", ServicePort: 9001, Protocol: "http", PathPrefix: "/check"},
+		},
+	}
+
+	extAuthz := controller1.ExtractExtAuthz(&pps)
+	testutils.AssertString(extAuthz.Service, "ns/sso")
+	testutils.AssertString(extAuthz.PathPrefix, "/check")
+	testutils.AssertInt64(int64(extAuthz.Timeout), int64(200*time.Millisecond))
+	if extAuthz.GRPC {
+		log.Fatalf("Authorization should use the HTTP service")
+	}
+
+	cluster := controller1.NewAuthzCluster(&pps, "left", 0)
+	testutils.AssertString(cluster.Name, "0-ns-sso")
+	testutils.AssertInt(cluster.EndpointConfig.ServicePort, 9001)
+	testutils.AssertInt(cluster.ConnectTimeout, 500)
+	if !cluster.IsAuthz || cluster.HealthCheck != nil {
+		log.Fatalf("Wrong authorization cluster: %+v", cluster)
+	}
+
+	pps.Spec.Type = "TCP"
+	if controller1.ExtractExtAuthz(&pps) != nil {
+		log.Fatalf("TCP services can't be authorized")
+	}
+}
+
+func Test_ExtractJWT(t *testing.T) {
+	pps := v1.ProPsyService{
+		ObjectMeta: v12.ObjectMeta{Namespace: "ns"},
+		Spec:       v1.ProPsyServiceSpec{Service: "app"},
+	}
+
+	if controller1.ExtractJWT(&pps) != nil {
+		log.Fatalf("JWT should be disabled without an issuer")
+	}
+
+	pps.Spec.JWT = v1.ProPsyServiceJWT{
+		Issuer:               "https://sso.example.com",
+		Audiences:            []string{"app"},
+		RemoteJWKSURI:        "https://sso.example.com/jwks.json",
+		RemoteJWKSCluster:    "sso",
+		ForwardPayloadHeader: "x-jwt-payload",
+	}
+	jwt := controller1.ExtractJWT(&pps)
+	testutils.AssertString(jwt.Issuer, "https://sso.example.com")
+	testutils.AssertString(jwt.RemoteJWKSCluster, "sso")
+	testutils.AssertString(jwt.ForwardPayloadHeader, "x-jwt-payload")
+	testutils.AssertInt(len(jwt.Audiences), 1)
+	if jwt.JWKS != nil {
+		log.Fatalf("Remote keys shouldn't be read from a secret")
+	}
+
+	if route := controller1.NewRouteConfig(&pps); route.JWT == nil {
+		log.Fatalf("The route should require JWT")
+	}
+
+	pps.Spec.Type = "TCP"
+	if controller1.ExtractJWT(&pps) != nil {
+		log.Fatalf("TCP services can't verify JWT")
+	}
+}
+
+func Test_UpstreamProtocol(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{Service: "app", UpstreamProtocol: "auto", WebSocket: true},
+	}
+
+	if controller1.NewCluster(&pps, "left", 0, false).UpstreamProtocol != propsy.AutoUpstream {
+		log.Fatalf("Upstream protocol was not set on the cluster")
+	}
+	if route := controller1.NewRouteConfig(&pps); !route.WebSocket || route.GRPC {
+		log.Fatalf("Route should allow websockets: %+v", route)
+	}
+
+	pps.Spec.Type = "GRPC"
+	pps.Spec.UpstreamProtocol = "HTTP1"
+	if GetUpstreamProtocol(&pps) != propsy.HTTP2Upstream {
+		log.Fatalf("gRPC services have to use HTTP2 upstream")
+	}
+	if !controller1.NewRouteConfig(&pps).GRPC || GetProxyType(pps.Spec.Type) != propsy.HTTP {
+		log.Fatalf("gRPC services should be proxied as HTTP")
+	}
+
+	pps.Spec.Type = "TCP"
+	if GetUpstreamProtocol(&pps) != propsy.HTTP1Upstream || controller1.NewRouteConfig(&pps).WebSocket {
+		log.Fatalf("TCP services have no HTTP options")
+	}
+}
+
+func Test_TCPServerNames(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{
+			Service:     "db",
+			Nodes:       []string{"node-sni"},
+			Listen:      "5432",
+			Type:        "TCP",
+			ServicePort: 5432,
+			Percent:     100,
+			Domains:     []string{"db.example.cz"},
+		},
+	}
+	pps2 := *pps.DeepCopy()
+	pps2.Spec.Service = "mq"
+	pps2.Spec.Domains = []string{"mq.example.cz"}
+
+	controller1.PPSAdded(&pps)
+	controller1.PPSAdded(&pps2)
+	node := ppsCache.GetOrCreateNode("node-sni")
+	testutils.AssertInt(len(node.Listeners), 1)
+	testutils.AssertInt(len(node.Listeners[0].VirtualHosts), 2)
+
+	controller1.PPSRemoved(&pps, false)
+	testutils.AssertInt(len(node.Listeners[0].VirtualHosts), 1)
+	testutils.AssertString(node.Listeners[0].VirtualHosts[0].Name, "mq.example.cz")
+
+	controller1.PPSRemoved(&pps2, false)
+	testutils.AssertInt(len(node.Listeners), 0)
+}
+
+func Test_ProxyProtocol(t *testing.T) {
+	pps := v1.ProPsyService{
+		Spec: v1.ProPsyServiceSpec{Service: "db", Type: "TCP", AcceptProxyProtocol: true, UpstreamProxyProtocol: "v2"},
+	}
+
+	if !controller1.NewRouteConfig(&pps).AcceptProxyProtocol {
+		log.Fatalf("Route should accept the PROXY protocol")
+	}
+	if controller1.NewCluster(&pps, "left", 0, false).ProxyProtocol != propsy.ProxyProtocolV2 {
+		log.Fatalf("PROXY protocol was not set on the cluster")
+	}
+
+	pps.Spec.UpstreamProxyProtocol = "v3"
+	if GetProxyProtocolVersion(&pps) != propsy.NoProxyProtocol {
+		log.Fatalf("Unknown PROXY protocol version shouldn't be sent")
+	}
+
+	pps.Spec.UpstreamProxyProtocol = "v1"
+	pps.Spec.Type = "HTTP"
+	if GetProxyProtocolVersion(&pps) != propsy.NoProxyProtocol {
+		log.Fatalf("HTTP services can't send the PROXY protocol")
+	}
+}
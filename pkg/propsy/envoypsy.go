@@ -40,6 +40,9 @@ var tlsVerifyCA string
 var tlsKey string
 var tlsCert string
 var tlsSkipCN bool
+var RateLimitCluster string
+var RateLimitDomain string
+var DefaultAccessLog = &AccessLogConfig{}
 
 func init() {
 	flag.StringVar(&LocalZone, "zone", "", "Local zone")
@@ -47,6 +50,13 @@ func init() {
 	flag.StringVar(&tlsCert, "servercert", "", "Server TLS Certificate")
 	flag.StringVar(&tlsKey, "serverkey", "", "Server TLS key")
 	flag.BoolVar(&tlsSkipCN, "peerskipcn", false, "Skip CN verify for peer certificate")
+	flag.StringVar(&RateLimitCluster, "ratelimitcluster", "", "Envoy cluster of the global rate limit gRPC service")
+	flag.StringVar(&RateLimitDomain, "ratelimitdomain", "propsy", "Domain of the global rate limit descriptors")
+	flag.StringVar(&DefaultAccessLog.Path, "accesslogpath", "", "Default access log file of the listeners, e.g. /dev/stdout")
+	flag.StringVar(&DefaultAccessLog.Cluster, "accesslogcluster", "", "Envoy cluster of the default gRPC access log service")
+	flag.StringVar(&DefaultAccessLog.Format, "accesslogformat", "", "Default access log format, a JSON object for JSON logs")
+	flag.IntVar(&DefaultAccessLog.MinStatus, "accesslogminstatus", 0, "Log only HTTP requests with at least this status code by default")
+	flag.IntVar(&DefaultAccessLog.SamplePercent, "accesslogsample", 0, "Log only this percent of requests by default, 0 logs all")
 }
 
 func InitGRPCServer() {
@@ -87,6 +97,7 @@ func InitGRPCServer() {
 		api.RegisterClusterDiscoveryServiceServer(grpcServer, server)
 		api.RegisterRouteDiscoveryServiceServer(grpcServer, server)
 		api.RegisterListenerDiscoveryServiceServer(grpcServer, server)
+		discovery.RegisterSecretDiscoveryServiceServer(grpcServer, server)
 
 		reflection.Register(grpcServer)
 		logrus.Info("XDS registered")
@@ -103,6 +114,14 @@ func UInt32FromInteger(val int) *types.UInt32Value {
 	}
 }
 
+// OptionalUInt32FromInteger leaves non-positive values unset so envoy falls back to its defaults
+func OptionalUInt32FromInteger(val int) *types.UInt32Value {
+	if val <= 0 {
+		return nil
+	}
+	return UInt32FromInteger(val)
+}
+
 func UInt64FromInteger(val int) *types.UInt64Value {
 	return &types.UInt64Value{
 		Value: uint64(val),
@@ -125,11 +144,33 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 	for l := range n.Listeners {
 		_listener := n.Listeners[l]
 		var vhosts []*route.VirtualHost
-		for v := range n.Listeners[l].VirtualHosts {
-			_vhost := _listener.VirtualHosts[v]
+		authzRoute := _listener.GetExtAuthzRoute()
+		compression := _listener.GetCompression()
+		vhostDomains := _listener.GetVHostDomains()
+		sortedVHosts := _listener.GetSortedVHosts()
+		for v := range sortedVHosts {
+			_vhost := sortedVHosts[v]
+			if len(vhostDomains[_vhost.Name]) == 0 {
+				logrus.Warnf("Skipping vhost %s on listener %s, all of its domains are served elsewhere", _vhost.Name, _listener.Name)
+				continue
+			}
+
 			var routes []*route.Route
-			for r := range _vhost.Routes {
-				_route := _vhost.Routes[r]
+			sortedRoutes := _vhost.GetSortedRoutes()
+			for r := range sortedRoutes {
+				_route := sortedRoutes[r]
+				if !_route.IsForwarding() {
+					envoyRoute := _route.ToEnvoy(nil) // redirects and direct responses need no clusters
+					if authzRoute != nil && _route.ExtAuthz == nil {
+						DisableExtAuthz(envoyRoute)
+					}
+					if compression != nil && _route.Compression != nil && _route.Compression.Disabled {
+						DisableCompression(envoyRoute)
+					}
+					routes = append(routes, envoyRoute)
+					continue
+				}
+
 				var routedClusters []*route.WeightedCluster_ClusterWeight
 
 				totalWeight, localZoneWeight, otherZoneWeight, canariesWeight, connectTimeout, maxRequests := _route.CalculateWeights()
@@ -144,13 +185,14 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 				// first setup local-zone cluster
 				endpointsAll := _route.GeneratePrioritizedEndpoints(LocalZone)
 
-				addEndpoints := endpointsAll.ToEnvoy(_listener.Name + "_" + _route.GenerateUniqueRouteName())
-				cluster := ClusterToEnvoy(_listener.Name+"_"+_route.GenerateUniqueRouteName(), connectTimeout, maxRequests, nil, nil)
+				localClusterName := GenerateClusterName(_listener.Name, _vhost, _route)
+				addEndpoints := endpointsAll.ToEnvoy(localClusterName)
+				cluster := ClusterToEnvoy(localClusterName, connectTimeout, maxRequests, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol)
 
 				if localCluster != nil {
-					cluster = ClusterToEnvoy(_listener.Name+"_"+_route.GenerateUniqueRouteName(), connectTimeout, maxRequests, localCluster.HealthCheck, localCluster.Outlier)
+					cluster = ClusterToEnvoy(localClusterName, connectTimeout, maxRequests, localCluster.HealthCheck, localCluster.Outlier, localCluster.UpstreamTLS, localCluster.CircuitBreakers, localCluster.LBPolicy, localCluster.UpstreamProtocol, localCluster.ProxyProtocol)
 				}
-				routedCluster := WeightedClusterToEnvoy(_listener.Name+"_"+_route.GenerateUniqueRouteName(), localZoneWeight)
+				routedCluster := WeightedClusterToEnvoy(localClusterName, localZoneWeight)
 
 				sendClusters = append(sendClusters, cluster)
 				routedClusters = append(routedClusters, routedCluster)
@@ -164,6 +206,9 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 						logrus.Debugf(".. Skipping!")
 						continue // skip canaries of other zones
 					}
+					if _cluster.IsMirror || _cluster.IsAuthz {
+						continue // mirrors are set up separately below, authorization per listener
+					}
 					if !_cluster.IsCanary && _cluster == localCluster {
 						logrus.Debugf("... Skipping too!")
 						continue // skip local zones
@@ -182,7 +227,7 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 					localityEndpoints := ClusterLoadAssignment{_cluster.EndpointConfig.ToEnvoy(0, 1)}
 
 					addEndpoints := localityEndpoints.ToEnvoy(_cluster.Name)
-					cluster := ClusterToEnvoy(_cluster.Name, _cluster.ConnectTimeout, _cluster.MaxRequests, localCluster.HealthCheck, localCluster.Outlier)
+					cluster := ClusterToEnvoy(_cluster.Name, _cluster.ConnectTimeout, _cluster.MaxRequests, localCluster.HealthCheck, localCluster.Outlier, localCluster.UpstreamTLS, localCluster.CircuitBreakers, localCluster.LBPolicy, localCluster.UpstreamProtocol, localCluster.ProxyProtocol)
 
 					routedCluster := WeightedClusterToEnvoy(_cluster.Name, weight)
 
@@ -190,13 +235,52 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 					routedClusters = append(routedClusters, routedCluster)
 					sendEndpoints = append(sendEndpoints, addEndpoints)
 				}
-				routes = append(routes, _route.ToEnvoy(routedClusters))
+				envoyRoute := _route.ToEnvoy(routedClusters)
+
+				// mirrored traffic goes to a single cluster prioritizing the local zone, just like the primary one
+				if _route.HasMirror() {
+					mirrorClusterName := localClusterName + "-mirror"
+					mirrorCluster := ClusterToEnvoy(mirrorClusterName, connectTimeout, maxRequests, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol)
+					if localMirror := _route.GetLocalBestMirror(); localMirror != nil {
+						mirrorCluster = ClusterToEnvoy(mirrorClusterName, localMirror.ConnectTimeout, localMirror.MaxRequests, localMirror.HealthCheck, localMirror.Outlier, localMirror.UpstreamTLS, localMirror.CircuitBreakers, localMirror.LBPolicy, localMirror.UpstreamProtocol, NoProxyProtocol)
+					}
+					mirrorEndpoints := _route.GenerateMirrorEndpoints()
+
+					sendClusters = append(sendClusters, mirrorCluster)
+					sendEndpoints = append(sendEndpoints, mirrorEndpoints.ToEnvoy(mirrorClusterName))
+					envoyRoute.GetRoute().RequestMirrorPolicy = _route.GenerateMirrorPolicy(mirrorClusterName)
+				}
+
+				if authzRoute != nil && _route.ExtAuthz == nil {
+					DisableExtAuthz(envoyRoute)
+				}
+				// the opt-out only makes sense when some route of the listener turns the gzip filter on
+				if compression != nil && _route.Compression != nil && _route.Compression.Disabled {
+					DisableCompression(envoyRoute)
+				}
+
+				routes = append(routes, envoyRoute)
 
 			}
 			vhost := _vhost.ToEnvoy(routes)
+			vhost.Domains = vhostDomains[_vhost.Name]
 			vhosts = append(vhosts, vhost)
 		}
 
+		// a single authorization cluster per listener, prioritizing the local zone
+		if authzRoute != nil {
+			authzClusterName := GenerateAuthzClusterName(_listener.Name)
+			authzProtocol := HTTP1Upstream
+			if authzRoute.ExtAuthz.GRPC {
+				authzProtocol = HTTP2Upstream
+			}
+			authzCluster := ClusterToEnvoy(authzClusterName, authzRoute.GetAuthzConnectTimeout(), 0, nil, nil, nil, nil, RoundRobinLB, authzProtocol, NoProxyProtocol)
+			authzEndpoints := authzRoute.GenerateAuthzEndpoints()
+
+			sendClusters = append(sendClusters, authzCluster)
+			sendEndpoints = append(sendEndpoints, authzEndpoints.ToEnvoy(authzClusterName))
+		}
+
 		addListener, err := _listener.ToEnvoy(vhosts)
 		if err != nil {
 			logrus.Warnf("Error generating listener: %s", err.Error())
@@ -210,7 +294,66 @@ func GenerateEnvoyConfig(n *NodeConfig) {
 	logrus.Debugf("Generated endpoints: %+v", sendEndpoints)
 	logrus.Debugf("Generated clusters: %+v", sendClusters)
 	logrus.Infof("Setting config for %s", n.NodeName)
-	snapshot := cache.NewSnapshot(time.Now().String(), sendEndpoints, sendClusters, nil, sendListeners)
+	version := time.Now().String()
+	snapshot := cache.NewSnapshot(version, sendEndpoints, sendClusters, nil, sendListeners)
+	snapshot.Secrets = cache.NewResources(version, GenerateSecrets(n))
+	_ = snapshotCache.SetSnapshot(n.NodeName, snapshot)
+}
+
+// GenerateSecrets collects the certificates and CAs of all vhosts and clusters on the node, each of them only once
+func GenerateSecrets(n *NodeConfig) []cache.Resource {
+	var sendSecrets []cache.Resource
+	seen := map[string]bool{}
+
+	for l := range n.Listeners {
+		for v := range n.Listeners[l].VirtualHosts {
+			tlsData := n.Listeners[l].VirtualHosts[v].TLSSecret
+			if tlsData != nil && tlsData.IsValid() && !seen[tlsData.Name] {
+				seen[tlsData.Name] = true
+				sendSecrets = append(sendSecrets, tlsData.ToEnvoySecret())
+			}
+
+			clientCA := n.Listeners[l].VirtualHosts[v].ClientCA
+			if clientCA != nil && clientCA.HasCA() && !seen[clientCA.GenerateCASecretName()] {
+				seen[clientCA.GenerateCASecretName()] = true
+				sendSecrets = append(sendSecrets, clientCA.ToEnvoyCASecret())
+			}
+
+			for r := range n.Listeners[l].VirtualHosts[v].Routes {
+				for c := range n.Listeners[l].VirtualHosts[v].Routes[r].Clusters {
+					upstreamTLS := n.Listeners[l].VirtualHosts[v].Routes[r].Clusters[c].UpstreamTLS
+					if upstreamTLS == nil {
+						continue
+					}
+
+					if upstreamTLS.CA != nil && upstreamTLS.CA.HasCA() && !seen[upstreamTLS.CA.GenerateCASecretName()] {
+						seen[upstreamTLS.CA.GenerateCASecretName()] = true
+						sendSecrets = append(sendSecrets, upstreamTLS.CA.ToEnvoyCASecret())
+					}
+
+					if upstreamTLS.Certificate != nil && upstreamTLS.Certificate.IsValid() && !seen[upstreamTLS.Certificate.Name] {
+						seen[upstreamTLS.Certificate.Name] = true
+						sendSecrets = append(sendSecrets, upstreamTLS.Certificate.ToEnvoySecret())
+					}
+				}
+			}
+		}
+	}
+
+	return sendSecrets
+}
+
+// GenerateEnvoySecrets pushes only new secrets to the node, the rest of the snapshot keeps its version so envoy
+// doesn't get new listeners (and doesn't drain the old ones) just because a certificate got rotated
+func GenerateEnvoySecrets(n *NodeConfig) {
+	snapshot, err := snapshotCache.GetSnapshot(n.NodeName)
+	if err != nil {
+		GenerateEnvoyConfig(n)
+		return
+	}
+
+	logrus.Infof("Setting secrets for %s", n.NodeName)
+	snapshot.Secrets = cache.NewResources(time.Now().String(), GenerateSecrets(n))
 	_ = snapshotCache.SetSnapshot(n.NodeName, snapshot)
 }
 
@@ -3,9 +3,17 @@ package propsy
 import (
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/seznam/ProPsy/pkg/testutils"
 	"log"
 	"testing"
 	"time"
@@ -23,9 +31,10 @@ func Test_generateClusterParts(T *testing.T) {
 
 	cla := lbEndpoints.ToEnvoy(clusterName)
 
+	connectTimeoutDuration := time.Duration(connectTimeout) * time.Millisecond
 	_cluster := &v2.Cluster{
 		Name:           clusterName,
-		ConnectTimeout: time.Duration(connectTimeout) * time.Millisecond,
+		ConnectTimeout: &connectTimeoutDuration,
 		ClusterDiscoveryType: &v2.Cluster_Type{
 			Type: v2.Cluster_EDS,
 		},
@@ -78,3 +87,325 @@ func Test_generateClusterParts(T *testing.T) {
 		log.Fatalf("Error generating cluster load assignment: \n%+v\n vs \n%+v", cla, _cla)
 	}
 }
+
+func Test_upstreamTLS(T *testing.T) {
+	upstreamTLS := &UpstreamTLSConfig{
+		SNI:         "backend.example.cz",
+		CA:          &TlsData{Name: "ns__backend-ca", CA: []byte("ca")},
+		Certificate: &TlsData{Name: "ns__backend-client", Certificate: []byte("crt"), Key: []byte("key")},
+	}
+
+	cluster := ClusterToEnvoy("foobar", 1000, 0, nil, nil, upstreamTLS, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol)
+	_tlsContext := &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{
+				Name:      "ns__backend-client",
+				SdsConfig: XDSConfigSource(),
+			}},
+			ValidationContextType: &auth.CommonTlsContext_ValidationContextSdsSecretConfig{
+				ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{
+					Name:      "ns__backend-ca__ca",
+					SdsConfig: XDSConfigSource(),
+				},
+			},
+		},
+		Sni: "backend.example.cz",
+	}
+
+	if !proto.Equal(cluster.TlsContext, _tlsContext) {
+		log.Fatalf("Error generating upstream TLS context: \n%+v\n vs \n%+v", cluster.TlsContext, _tlsContext)
+	}
+
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol).TlsContext != nil {
+		log.Fatalf("Upstream TLS context generated without being asked for")
+	}
+
+	node := NodeConfig{Listeners: []*ListenerConfig{{VirtualHosts: []*VirtualHost{{Routes: []*RouteConfig{{Clusters: []*ClusterConfig{
+		{Name: "a", UpstreamTLS: upstreamTLS},
+		{Name: "b", UpstreamTLS: upstreamTLS},
+	}}}}}}}}
+	testutils.AssertInt(len(GenerateSecrets(&node)), 2)
+}
+
+func Test_circuitBreakers(T *testing.T) {
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol).CircuitBreakers != nil {
+		log.Fatalf("Circuit breakers generated without being asked for")
+	}
+
+	circuitBreakers := &CircuitBreakersConfig{
+		Default: &CircuitBreakerThresholds{MaxConnections: 10000, MaxRequests: 20000},
+		High:    &CircuitBreakerThresholds{MaxPendingRequests: 500, MaxRetries: 10},
+	}
+
+	_circuitBreakers := &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:       core.RoutingPriority_DEFAULT,
+			MaxConnections: &types.UInt32Value{Value: 10000},
+			MaxRequests:    &types.UInt32Value{Value: 20000},
+		}, {
+			Priority:           core.RoutingPriority_HIGH,
+			MaxPendingRequests: &types.UInt32Value{Value: 500},
+			MaxRetries:         &types.UInt32Value{Value: 10},
+		}},
+	}
+
+	envoyCluster := ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, circuitBreakers, RoundRobinLB, HTTP1Upstream, NoProxyProtocol)
+	if !proto.Equal(envoyCluster.CircuitBreakers, _circuitBreakers) {
+		log.Fatalf("Error generating circuit breakers: \n%+v\n vs \n%+v", envoyCluster.CircuitBreakers, _circuitBreakers)
+	}
+}
+
+func Test_upstreamProtocol(T *testing.T) {
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol).Http2ProtocolOptions != nil {
+		log.Fatalf("HTTP1 should be the default upstream protocol")
+	}
+
+	http2 := ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP2Upstream, NoProxyProtocol)
+	if http2.Http2ProtocolOptions == nil || http2.ProtocolSelection != api.Cluster_USE_CONFIGURED_PROTOCOL {
+		log.Fatalf("HTTP2 upstream was not set: %+v", http2)
+	}
+
+	auto := ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, AutoUpstream, NoProxyProtocol)
+	if auto.Http2ProtocolOptions == nil || auto.ProtocolSelection != api.Cluster_USE_DOWNSTREAM_PROTOCOL {
+		log.Fatalf("Upstream should use the downstream protocol: %+v", auto)
+	}
+}
+
+func Test_upstreamProxyProtocol(T *testing.T) {
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol).TransportSocket != nil {
+		log.Fatalf("PROXY protocol sent without being asked for")
+	}
+
+	_transportSocket := &core.TransportSocket{
+		Name: UpstreamProxyProtocolSocket,
+		ConfigType: &core.TransportSocket_Config{
+			Config: &types.Struct{Fields: map[string]*types.Value{
+				"config":           StructValue(map[string]*types.Value{"version": StringValue("V2")}),
+				"transport_socket": StructValue(map[string]*types.Value{"name": StringValue(RawBufferSocket)}),
+			}},
+		},
+	}
+	cluster := ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, ProxyProtocolV2)
+	if !proto.Equal(cluster.TransportSocket, _transportSocket) {
+		log.Fatalf("PROXY protocol socket does not match: %+v vs %+v", cluster.TransportSocket, _transportSocket)
+	}
+
+	// upstream tls moves into the proxy protocol socket
+	upstreamTLS := &UpstreamTLSConfig{SNI: "backend.example.cz"}
+	cluster = ClusterToEnvoy("foobar", 1000, 0, nil, nil, upstreamTLS, nil, RoundRobinLB, HTTP1Upstream, ProxyProtocolV1)
+	if cluster.TlsContext != nil {
+		log.Fatalf("Upstream TLS should be wrapped by the PROXY protocol socket")
+	}
+	socketFields := cluster.TransportSocket.GetConfig().Fields
+	testutils.AssertString(socketFields["config"].GetStructValue().Fields["version"].GetStringValue(), "V1")
+	innerSocket := socketFields["transport_socket"].GetStructValue().Fields
+	testutils.AssertString(innerSocket["name"].GetStringValue(), TLSSocket)
+	tlsConfig := innerSocket["typed_config"].GetStructValue().Fields
+	testutils.AssertString(tlsConfig["@type"].GetStringValue(), UpstreamTLSContextType)
+	testutils.AssertString(tlsConfig["sni"].GetStringValue(), "backend.example.cz")
+}
+
+func Test_lbPolicy(T *testing.T) {
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, RoundRobinLB, HTTP1Upstream, NoProxyProtocol).LbPolicy != api.Cluster_ROUND_ROBIN {
+		log.Fatalf("Round robin should be the default lb policy")
+	}
+
+	if ClusterToEnvoy("foobar", 1000, 0, nil, nil, nil, nil, MaglevLB, HTTP1Upstream, NoProxyProtocol).LbPolicy != api.Cluster_MAGLEV {
+		log.Fatalf("Maglev lb policy was not set")
+	}
+
+	routeConfig := RouteConfig{
+		Name: "sticky",
+		HashPolicies: []*HashPolicyConfig{
+			{Cookie: "session", CookieTTL: time.Hour, CookiePath: "/", Terminal: true},
+			{},
+			{SourceIP: true},
+		},
+	}
+
+	ttl := time.Hour
+	_hashPolicies := []*route.RouteAction_HashPolicy{{
+		PolicySpecifier: &route.RouteAction_HashPolicy_Cookie_{
+			Cookie: &route.RouteAction_HashPolicy_Cookie{Name: "session", Ttl: &ttl, Path: "/"},
+		},
+		Terminal: true,
+	}, {
+		PolicySpecifier: &route.RouteAction_HashPolicy_ConnectionProperties_{
+			ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+		},
+	}}
+
+	hashPolicies := routeConfig.GenerateHashPolicies()
+	testutils.AssertInt(len(hashPolicies), len(_hashPolicies))
+	for i := range hashPolicies {
+		if !proto.Equal(hashPolicies[i], _hashPolicies[i]) {
+			log.Fatalf("Error generating hash policy: \n%+v\n vs \n%+v", hashPolicies[i], _hashPolicies[i])
+		}
+	}
+}
+
+func TestGenerateEnvoyConfigCompression(T *testing.T) {
+	LocalZone = "test"
+	snapshotCache = cache.NewSnapshotCache(false, Hasher{}, nil)
+
+	primary := &ClusterConfig{Name: "0-ns-app", Weight: 100, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-app", ServicePort: 8080, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "10.0.0.1", Weight: 1, Healthy: true}},
+	}}
+	text := &RouteConfig{Name: "text", PathPrefix: "/text", Clusters: []*ClusterConfig{primary}, Compression: &CompressionConfig{}}
+	binary := &RouteConfig{Name: "binary", PathPrefix: "/", Clusters: []*ClusterConfig{primary}, Compression: &CompressionConfig{Disabled: true}}
+
+	node := NodeConfig{NodeName: "compression-node"}
+	node.AddListener(&ListenerConfig{Name: "foobar", Listen: "8080", Type: HTTP, TrackedLocality: []string{"test"},
+		VirtualHosts: []*VirtualHost{{Name: "*", Domains: []string{"*"}, Routes: []*RouteConfig{text, binary}}}})
+
+	routes := func() []*route.Route {
+		GenerateEnvoyConfig(&node)
+		snapshot, err := snapshotCache.GetSnapshot("compression-node")
+		if err != nil {
+			log.Fatalf("No snapshot generated: %s", err.Error())
+		}
+		envoyListener := snapshot.Listeners.Items["foobar"].(*v2.Listener)
+		connectionManager := &hcm.HttpConnectionManager{}
+		if err := util.StructToMessage(envoyListener.FilterChains[0].Filters[0].GetConfig(), connectionManager); err != nil {
+			log.Fatalf("Error reading the connection manager: %s", err.Error())
+		}
+		return connectionManager.GetRouteConfig().VirtualHosts[0].Routes
+	}
+
+	// only the route opting out of the listener's gzip gets the no-transform directive
+	compressedRoutes := routes()
+	testutils.AssertInt(len(compressedRoutes), 2)
+	testutils.AssertInt(len(compressedRoutes[0].ResponseHeadersToAdd), 0)
+	testutils.AssertInt(len(compressedRoutes[1].ResponseHeadersToAdd), 1)
+	testutils.AssertString(compressedRoutes[1].ResponseHeadersToAdd[0].Header.Value, "no-transform")
+
+	// nothing to opt out of without the gzip filter, the responses stay untouched
+	text.Compression = nil
+	for _, r := range routes() {
+		if len(r.ResponseHeadersToAdd) != 0 {
+			log.Fatalf("Route shouldn't change the responses without compression: %+v", r.ResponseHeadersToAdd)
+		}
+	}
+}
+
+func TestGenerateEnvoyConfigExtAuthz(T *testing.T) {
+	LocalZone = "test"
+	snapshotCache = cache.NewSnapshotCache(false, Hasher{}, nil)
+
+	authz := &ClusterConfig{Name: "1-ns-sso", ConnectTimeout: 300, IsAuthz: true, Priority: 1, EndpointConfig: &EndpointConfig{
+		Name: "1-ns-sso", ServicePort: 9001, Locality: &Locality{Zone: "other"},
+		Endpoints: []*Endpoint{{Host: "10.0.0.3", Weight: 1, Healthy: true}},
+	}}
+	primary := &ClusterConfig{Name: "0-ns-app", Weight: 100, ConnectTimeout: 500, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-app", ServicePort: 8080, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "10.0.0.1", Weight: 1, Healthy: true}},
+	}}
+	internal := &RouteConfig{Name: "internal", PathPrefix: "/internal", Clusters: []*ClusterConfig{primary, authz},
+		ExtAuthz: &ExtAuthzConfig{Service: "ns/sso", GRPC: true, Timeout: time.Second}}
+	public := &RouteConfig{Name: "public", PathPrefix: "/", Clusters: []*ClusterConfig{primary}}
+	redirect := &RouteConfig{Name: "old", PathPrefix: "/old", Redirect: &RedirectConfig{Path: "/new"}}
+
+	node := NodeConfig{NodeName: "authz-node"}
+	node.AddListener(&ListenerConfig{Name: "foobar", Listen: "8080", Type: HTTP, TrackedLocality: []string{"test"},
+		VirtualHosts: []*VirtualHost{{Name: "*", Domains: []string{"*"}, Routes: []*RouteConfig{internal, redirect, public}}}})
+	GenerateEnvoyConfig(&node)
+
+	snapshot, err := snapshotCache.GetSnapshot("authz-node")
+	if err != nil {
+		log.Fatalf("No snapshot generated: %s", err.Error())
+	}
+
+	// the authorization service is only tracked in the other zone, its connect timeout is still the PPS one
+	authzCluster := snapshot.Clusters.Items["foobar-authz"].(*v2.Cluster)
+	if *authzCluster.ConnectTimeout != 300*time.Millisecond {
+		log.Fatalf("Wrong authorization connect timeout: %s", authzCluster.ConnectTimeout)
+	}
+
+	envoyListener := snapshot.Listeners.Items["foobar"].(*v2.Listener)
+	connectionManager := &hcm.HttpConnectionManager{}
+	if err := util.StructToMessage(envoyListener.FilterChains[0].Filters[0].GetConfig(), connectionManager); err != nil {
+		log.Fatalf("Error reading the connection manager: %s", err.Error())
+	}
+	routes := connectionManager.GetRouteConfig().VirtualHosts[0].Routes
+	testutils.AssertInt(len(routes), 3)
+	if _, ok := routes[0].PerFilterConfig[util.HTTPExternalAuthorization]; ok {
+		log.Fatalf("Route asking for authorization has it disabled")
+	}
+	for _, r := range routes[1:] {
+		if !proto.Equal(r.PerFilterConfig[util.HTTPExternalAuthorization], DisabledExtAuthz()) {
+			log.Fatalf("Authorization should be disabled on route %s", r.Match.GetPrefix())
+		}
+	}
+}
+
+func TestGenerateEnvoyConfigTCPWeights(T *testing.T) {
+	LocalZone = "test"
+	snapshotCache = cache.NewSnapshotCache(false, Hasher{}, nil)
+
+	local := &ClusterConfig{Name: "0-ns-db", Weight: 80, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-db", ServicePort: 5432, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "1.1.1.1", Weight: 1, Healthy: true}},
+	}}
+	other := &ClusterConfig{Name: "1-ns-db", Weight: 80, Priority: 1, EndpointConfig: &EndpointConfig{
+		Name: "1-ns-db", ServicePort: 5432, Locality: &Locality{Zone: "other"},
+		Endpoints: []*Endpoint{{Host: "2.2.2.2", Weight: 1, Healthy: true}},
+	}}
+	canary := &ClusterConfig{Name: "0-ns-db-canary", Weight: 10, IsCanary: true, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-db-canary", ServicePort: 5432, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "3.3.3.3", Weight: 1, Healthy: true}},
+	}}
+	routeConfig := &RouteConfig{Name: "db", PathPrefix: "/", Clusters: []*ClusterConfig{local, other, canary}}
+
+	node := NodeConfig{NodeName: "tcp-node"}
+	node.AddListener(&ListenerConfig{Name: "foobar", Listen: "5432", Type: TCP, TrackedLocality: []string{"test", "other"},
+		VirtualHosts: []*VirtualHost{{Name: "*", Domains: []string{"*"}, Routes: []*RouteConfig{routeConfig}}}})
+
+	weightedClusters := func() []*tcp.TcpProxy_WeightedCluster_ClusterWeight {
+		GenerateEnvoyConfig(&node)
+		snapshot, err := snapshotCache.GetSnapshot("tcp-node")
+		if err != nil {
+			log.Fatalf("No snapshot generated: %s", err.Error())
+		}
+		envoyListener := snapshot.Listeners.Items["foobar"].(*v2.Listener)
+		testutils.AssertInt(len(envoyListener.FilterChains), 1)
+		filters := envoyListener.FilterChains[0].Filters
+		testutils.AssertString(filters[len(filters)-1].Name, util.TCPProxy)
+		tcpProxy := &tcp.TcpProxy{}
+		if err := util.StructToMessage(filters[len(filters)-1].GetConfig(), tcpProxy); err != nil {
+			log.Fatalf("Error reading the tcp proxy: %s", err.Error())
+		}
+		return tcpProxy.GetWeightedClusters().Clusters
+	}
+
+	// the zones and the canary split the connections the same way they split HTTP requests
+	localClusterName := GenerateClusterName("foobar", node.Listeners[0].VirtualHosts[0], routeConfig)
+	_weightedClusters := []*tcp.TcpProxy_WeightedCluster_ClusterWeight{
+		{Name: localClusterName, Weight: 80},
+		{Name: "1-ns-db", Weight: 20},
+		{Name: "0-ns-db-canary", Weight: 10},
+	}
+	clusters := weightedClusters()
+	testutils.AssertInt(len(clusters), len(_weightedClusters))
+	for i := range clusters {
+		if !proto.Equal(clusters[i], _weightedClusters[i]) {
+			log.Fatalf("TCP weights do not match: %+v vs %+v", clusters[i], _weightedClusters[i])
+		}
+	}
+
+	// clusters without weight are left out
+	local.Weight = 100
+	canary.Weight = 0
+	clusters = weightedClusters()
+	testutils.AssertInt(len(clusters), 1)
+	testutils.AssertString(clusters[0].Name, localClusterName)
+	testutils.AssertInt(int(clusters[0].Weight), 100)
+
+	// with no weight at all, the local zone cluster still gets the connections
+	local.Weight = 0
+	other.EndpointConfig.Endpoints = nil
+	clusters = weightedClusters()
+	testutils.AssertInt(len(clusters), 1)
+	testutils.AssertString(clusters[0].Name, localClusterName)
+	testutils.AssertInt(int(clusters[0].Weight), 1)
+}
@@ -10,8 +10,23 @@ import (
 )
 
 type TlsData struct {
+	Name        string // name of the SDS secret
 	Certificate []byte
 	Key         []byte
+	CA          []byte // used to verify client certificates
+	JWKS        []byte // keys verifying JWT tokens
+}
+
+func (T *TlsData) IsValid() bool {
+	return len(T.Key) != 0 && len(T.Certificate) != 0
+}
+
+func (T *TlsData) HasCA() bool {
+	return len(T.CA) != 0
+}
+
+func (T *TlsData) GenerateCASecretName() string {
+	return T.Name + "__ca"
 }
 
 type ProPsyCache struct {
@@ -134,15 +149,44 @@ func (P *ProPsyCache) RemoveTLSWatch(secretNamespace, secretName string, node *N
 	logrus.Warnf("Failed to remove node %s from TLS %s", node.NodeName, secretName)
 }
 
-func (C *ProPsyCache) UpdateTLS(secretNamespace, secretName string, certificate, key []byte) bool {
+func (C *ProPsyCache) UpdateTLS(secretNamespace, secretName string, certificate, key, ca []byte) bool {
 	tls := C.GetTls(secretNamespace, secretName)
 	if tls == nil {
 		return false
 	}
 
 	logrus.Debugf("Updating TLS %s to new data", secretName)
+	wasValid, hadCA := tls.IsValid(), tls.HasCA()
 	tls.Certificate = certificate
 	tls.Key = key
+	tls.CA = ca
+
+	secretName = fmt.Sprintf("%s__%s", secretNamespace, secretName)
+	for i := range C.tlsNodes[secretName] {
+		// filter chains only change when the certificate appears or disappears, otherwise pushing the secret is enough
+		if wasValid != tls.IsValid() || hadCA != tls.HasCA() {
+			C.tlsNodes[secretName][i].Update()
+		} else {
+			C.tlsNodes[secretName][i].UpdateSecrets()
+		}
+	}
+
+	return true
+}
+
+// UpdateJWKS sets the JWT keys of a secret, they are inlined in the listeners so those have to be regenerated
+func (C *ProPsyCache) UpdateJWKS(secretNamespace, secretName string, jwks []byte) bool {
+	tls := C.GetTls(secretNamespace, secretName)
+	if tls == nil {
+		return false
+	}
+
+	if string(tls.JWKS) == string(jwks) {
+		return true
+	}
+
+	logrus.Debugf("Updating JWKS %s to new data", secretName)
+	tls.JWKS = jwks
 
 	secretName = fmt.Sprintf("%s__%s", secretNamespace, secretName)
 	for i := range C.tlsNodes[secretName] {
@@ -180,7 +224,7 @@ func (P *ProPsyCache) GetOrCreateTLS(namespace, name string) *TlsData {
 		return tls
 	}
 
-	secret := &TlsData{}
+	secret := &TlsData{Name: name}
 	P.tlsSecrets[name] = secret
 	return secret
 }
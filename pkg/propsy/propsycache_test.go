@@ -26,6 +26,9 @@ func Test_Nodes(t *testing.T) {
 	if tlsA != ppscache.GetTls("namespace", "name") {
 		log.Fatal("Got wrong TLS")
 	}
+	if tlsA.Name != "namespace__name" {
+		log.Fatal("Got wrong TLS secret name")
+	}
 
 	ppscache.GetTls("namespace", "name").Certificate = []byte{'a'}
 	ppscache.GetTls("namespace", "name").Key = []byte{'b'}
@@ -34,7 +37,7 @@ func Test_Nodes(t *testing.T) {
 		log.Fatal("Error setting TLS")
 	}
 
-	ppscache.UpdateTLS("namespace", "name", []byte{'c'}, []byte{'d'})
+	ppscache.UpdateTLS("namespace", "name", []byte{'c'}, []byte{'d'}, nil)
 	if ppscache.GetTls("namespace", "name").Certificate[0] != 'c' {
 		log.Fatal("Error setting TLS")
 	}
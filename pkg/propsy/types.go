@@ -3,6 +3,9 @@ package propsy
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,6 +22,7 @@ type ProxyType int
 const (
 	HTTP ProxyType = iota
 	TCP
+	UDP
 )
 
 type HealthCheckType int
@@ -30,6 +34,50 @@ const (
 	GRPCHealthCheck
 )
 
+type LBPolicy int
+
+const (
+	RoundRobinLB LBPolicy = iota
+	LeastRequestLB
+	RingHashLB
+	RandomLB
+	MaglevLB
+)
+
+type UpstreamProtocol int
+
+const (
+	HTTP1Upstream UpstreamProtocol = iota
+	HTTP2Upstream
+	AutoUpstream // same as the downstream connection
+)
+
+type ProxyProtocolVersion int
+
+const (
+	NoProxyProtocol ProxyProtocolVersion = iota
+	ProxyProtocolV1
+	ProxyProtocolV2
+)
+
+type CompressionLevel int
+
+const (
+	DefaultCompression CompressionLevel = iota
+	BestCompression
+	FastestCompression
+)
+
+// HashPolicyConfig hashes on the first of Header, Cookie and SourceIP that is set
+type HashPolicyConfig struct {
+	Header     string
+	Cookie     string
+	CookieTTL  time.Duration
+	CookiePath string
+	SourceIP   bool
+	Terminal   bool
+}
+
 type HealthCheckConfig struct {
 	Timeout           time.Duration
 	Interval          time.Duration
@@ -51,61 +99,296 @@ type OutlierConfig struct {
 	MinimumRequests     int
 }
 
+// CircuitBreakerThresholds with zero values are left to envoy defaults. A retry budget replaces MaxRetries, it limits
+// the concurrent retries to RetryBudgetPercent of the active requests, but at least to MinRetryConcurrency.
+type CircuitBreakerThresholds struct {
+	MaxConnections      int
+	MaxPendingRequests  int
+	MaxRequests         int
+	MaxRetries          int
+	RetryBudgetPercent  int
+	MinRetryConcurrency int
+}
+
+type CircuitBreakersConfig struct {
+	Default *CircuitBreakerThresholds
+	High    *CircuitBreakerThresholds
+}
+
+// FaultInjectionConfig delays and/or aborts the given percentage of requests, optionally only those matching Headers
+type FaultInjectionConfig struct {
+	DelayPercent int
+	Delay        time.Duration
+	AbortPercent int
+	AbortStatus  int
+	Headers      []*HeaderMatchConfig
+}
+
+// ExtAuthzConfig asks the authorization service whether a request may pass, over gRPC or plain HTTP
+type ExtAuthzConfig struct {
+	Service          string // namespace/name of the authorization service
+	GRPC             bool
+	PathPrefix       string // HTTP service only
+	Timeout          time.Duration
+	FailureModeAllow bool
+}
+
+// JWTConfig requires a token of Issuer for the route, verified by the keys from a secret or a remote JWKS
+type JWTConfig struct {
+	Issuer               string
+	Audiences            []string
+	JWKS                 *TlsData // secret holding the keys, unless they are fetched from RemoteJWKSURI
+	RemoteJWKSURI        string
+	RemoteJWKSCluster    string
+	Forward              bool
+	ForwardPayloadHeader string
+}
+
+// LocalRateLimitConfig is a token bucket refilled with Requests tokens every Interval, holding at most Burst of them.
+// It is shared by the whole listener when PerListener is set, TCP listeners always limit the connections this way.
+type LocalRateLimitConfig struct {
+	Requests    int
+	Interval    time.Duration
+	Burst       int
+	PerListener bool
+}
+
+// RateLimitActionConfig fills one descriptor entry from the first of Header, RemoteAddress and GenericKey that is set
+type RateLimitActionConfig struct {
+	Header        string
+	DescriptorKey string // defaults to the header name
+	RemoteAddress bool
+	GenericKey    string
+}
+
+// RateLimitDescriptorConfig is sent to the global rate limit service as a single descriptor
+type RateLimitDescriptorConfig struct {
+	Actions []*RateLimitActionConfig
+}
+
+type AccessLogConfig struct {
+	Path          string // file to write the logs to, e.g. /dev/stdout
+	Cluster       string // envoy cluster of a gRPC access log service
+	Format        string // a JSON object is used as a JSON format
+	MinStatus     int
+	SamplePercent int
+	Disabled      bool
+}
+
+// IsEnabled tells whether the logs go anywhere
+func (A *AccessLogConfig) IsEnabled() bool {
+	return A != nil && !A.Disabled && (A.Path != "" || A.Cluster != "")
+}
+
+type CompressionConfig struct {
+	ContentTypes []string
+	MinLength    int
+	Level        CompressionLevel
+	Disabled     bool // opts the route out of the listener's compression
+}
+
+type CorsConfig struct {
+	AllowOrigins     []string
+	AllowOriginRegex []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           int
+	AllowCredentials bool
+	PerVHost         bool
+}
+
+type RedirectConfig struct {
+	HTTPSRedirect bool
+	Host          string
+	Port          int
+	Path          string
+	PrefixRewrite string
+	ResponseCode  int
+	StripQuery    bool
+}
+
+type DirectResponseConfig struct {
+	Status int
+	Body   string
+}
+
+type HeaderValueConfig struct {
+	Name   string
+	Value  string // may contain envoy substitutions like %DOWNSTREAM_REMOTE_ADDRESS%
+	Append bool
+}
+
+type HeadersConfig struct {
+	RequestHeadersToAdd     []*HeaderValueConfig
+	RequestHeadersToRemove  []string
+	ResponseHeadersToAdd    []*HeaderValueConfig
+	ResponseHeadersToRemove []string
+}
+
+type RetryPolicyConfig struct {
+	RetryOn                  string
+	NumRetries               int
+	PerTryTimeout            time.Duration
+	RetriableStatusCodes     []int
+	AvoidPreviousHosts       bool
+	HostSelectionMaxAttempts int
+	BackOffBaseInterval      time.Duration
+	BackOffMaxInterval       time.Duration
+}
+
+// UpstreamTLSConfig makes envoy talk TLS to the endpoints
+type UpstreamTLSConfig struct {
+	SNI         string
+	CA          *TlsData // verifies the endpoint certificates when set
+	Certificate *TlsData // presented to the endpoints when set
+}
+
+type HeaderMatchType int
+
+const (
+	HeaderExactMatch HeaderMatchType = iota
+	HeaderRegexMatch
+	HeaderPrefixMatch
+	HeaderSuffixMatch
+	HeaderPresentMatch
+)
+
+type HeaderMatchConfig struct {
+	Name   string
+	Value  string
+	Type   HeaderMatchType
+	Invert bool
+}
+
+func (H *HeaderMatchConfig) String() string {
+	return fmt.Sprintf("Name: %s, Value: %s, Type: %d, Invert: %v",
+		H.Name, H.Value, H.Type, H.Invert)
+}
+
+type QueryParameterMatchConfig struct {
+	Name  string
+	Value string
+	Regex bool
+}
+
+func (Q *QueryParameterMatchConfig) String() string {
+	return fmt.Sprintf("Name: %s, Value: %s, Regex: %v",
+		Q.Name, Q.Value, Q.Regex)
+}
+
+// MatchConfig holds everything a route matches on besides the path prefix
+type MatchConfig struct {
+	Path            string // exact path, overrides the prefix
+	Regex           string // path regex, overrides the prefix
+	Headers         []*HeaderMatchConfig
+	QueryParameters []*QueryParameterMatchConfig
+}
+
+func (M *MatchConfig) String() string {
+	if M == nil {
+		return "<nil>"
+	}
+
+	// sort the matchers so the same set in a different order gives the same string
+	headers := make([]string, len(M.Headers))
+	for i := range M.Headers {
+		headers[i] = M.Headers[i].String()
+	}
+	sort.Strings(headers)
+
+	queryParameters := make([]string, len(M.QueryParameters))
+	for i := range M.QueryParameters {
+		queryParameters[i] = M.QueryParameters[i].String()
+	}
+	sort.Strings(queryParameters)
+
+	return fmt.Sprintf("Path: %s, Regex: %s, Headers: %v, QueryParameters: %v",
+		M.Path, M.Regex, headers, queryParameters)
+}
+
 type ListenerConfig struct {
 	Name            string
 	Listen          string
 	VirtualHosts    []*VirtualHost
 	Type            ProxyType
 	TrackedLocality []string
-	TLSSecret       *TlsData
 
 	mu sync.Mutex
 }
 
 func (L *ListenerConfig) String() string {
-	return fmt.Sprintf("Name: %s, Listen: %s, Type: %d, TrackedLocality: %s, TLSSecret: \n%v\nVirtualHosts: \n%+v",
-		L.Name, L.Listen, L.Type, L.TrackedLocality, L.TLSSecret, L.VirtualHosts)
+	return fmt.Sprintf("Name: %s, Listen: %s, Type: %d, TrackedLocality: %s, VirtualHosts: \n%+v",
+		L.Name, L.Listen, L.Type, L.TrackedLocality, L.VirtualHosts)
 }
 
 type RouteConfig struct {
-	Name          string
-	Clusters      []*ClusterConfig
-	PathPrefix    string
-	PrefixRewrite string
-	Timeout       time.Duration
+	Name                 string
+	Clusters             []*ClusterConfig
+	PathPrefix           string
+	PrefixRewrite        string
+	Timeout              time.Duration
+	Match                *MatchConfig
+	RetryPolicy          *RetryPolicyConfig
+	HashPolicies         []*HashPolicyConfig
+	Fault                *FaultInjectionConfig
+	RateLimit            *LocalRateLimitConfig
+	RateLimitDescriptors []*RateLimitDescriptorConfig
+	Headers              *HeadersConfig
+	VHostHeaders         *HeadersConfig // merged with the other routes' ones into the vhost
+	Redirect             *RedirectConfig
+	DirectResponse       *DirectResponseConfig
+	Cors                 *CorsConfig
+	AccessLog            *AccessLogConfig // overrides the daemon default for the whole listener
+	Compression          *CompressionConfig
+	ExtAuthz             *ExtAuthzConfig
+	JWT                  *JWTConfig
+	WebSocket            bool
+	GRPC                 bool // honors the grpc-timeout header up to the route timeout
+	AcceptProxyProtocol  bool // set for the whole listener
 }
 
 func (R *RouteConfig) String() string {
-	return fmt.Sprintf("Name: %s, PathPrefix: %s, PrefixRewrite: %s, Timeout: %s, Clusters:\n%+v",
-		R.Name, R.PathPrefix, R.PrefixRewrite, R.Timeout.String(), R.Clusters)
+	return fmt.Sprintf("Name: %s, PathPrefix: %s, PrefixRewrite: %s, Timeout: %s, Match: %s, RetryPolicy: %+v, Clusters:\n%+v",
+		R.Name, R.PathPrefix, R.PrefixRewrite, R.Timeout.String(), R.Match, R.RetryPolicy, R.Clusters)
 }
 
 type VirtualHost struct {
-	Name    string
-	Domains []string
-	Routes  []*RouteConfig
+	Name              string
+	Domains           []string
+	Routes            []*RouteConfig
+	TLSSecret         *TlsData // served to clients asking for one of the domains via SNI
+	ClientCA          *TlsData // when set, clients have to present a certificate signed by this CA
+	ClientAllowedSANs []string
 }
 
 func (V *VirtualHost) String() string {
-	return fmt.Sprintf("Name: %s, Domains: %v, Routes:\n%+v",
-		V.Name, V.Domains, V.Routes)
+	return fmt.Sprintf("Name: %s, Domains: %v, TLSSecret: %v, ClientCA: %v, ClientAllowedSANs: %v, Routes:\n%+v",
+		V.Name, V.Domains, V.TLSSecret, V.ClientCA, V.ClientAllowedSANs, V.Routes)
 }
 
 type ClusterConfig struct {
-	Name           string
-	ConnectTimeout int
-	EndpointConfig *EndpointConfig
-	Weight         int
-	IsCanary       bool
-	MaxRequests    int
-	Priority       int
-	HealthCheck    *HealthCheckConfig
-	Outlier        *OutlierConfig
+	Name             string
+	ConnectTimeout   int
+	EndpointConfig   *EndpointConfig
+	Weight           int
+	IsCanary         bool
+	IsMirror         bool // mirrors only receive shadowed copies of the requests
+	IsAuthz          bool // authorization service, only called by the ext_authz filter
+	MaxRequests      int
+	Priority         int
+	HealthCheck      *HealthCheckConfig
+	Outlier          *OutlierConfig
+	UpstreamTLS      *UpstreamTLSConfig
+	CircuitBreakers  *CircuitBreakersConfig
+	LBPolicy         LBPolicy
+	UpstreamProtocol UpstreamProtocol
+	ProxyProtocol    ProxyProtocolVersion // sent to the upstream before any data
 }
 
 func (C *ClusterConfig) String() string {
-	return fmt.Sprintf("Name: %s, ConnectTimeout: %d, Weight: %d, MaxRequests: %d, IsCanary: %v, EndpointConfig: %+v",
-		C.Name, C.ConnectTimeout, C.Weight, C.MaxRequests, C.IsCanary, C.EndpointConfig)
+	return fmt.Sprintf("Name: %s, ConnectTimeout: %d, Weight: %d, MaxRequests: %d, IsCanary: %v, IsMirror: %v, IsAuthz: %v, EndpointConfig: %+v",
+		C.Name, C.ConnectTimeout, C.Weight, C.MaxRequests, C.IsCanary, C.IsMirror, C.IsAuthz, C.EndpointConfig)
 }
 
 type EndpointConfig struct {
@@ -136,6 +419,10 @@ func (N *NodeConfig) Update() {
 	GenerateEnvoyConfig(N)
 }
 
+func (N *NodeConfig) UpdateSecrets() {
+	GenerateEnvoySecrets(N)
+}
+
 func (N *NodeConfig) Free() {
 	// free all the resources to avoid memleaks by keeping refs somewhere
 	logrus.Debugf("Removing everything from node: %s", N.NodeName)
@@ -249,6 +536,11 @@ func (V *VirtualHost) SafeRemoveRoute(route string, clusterName string) {
 	}
 }
 
+// IsForwarding tells whether the route sends requests to clusters instead of answering them by itself
+func (R *RouteConfig) IsForwarding() bool {
+	return R.Redirect == nil && R.DirectResponse == nil
+}
+
 func (R *RouteConfig) AddCluster(c *ClusterConfig) {
 	if i := R.FindCluster(c.Name); i != nil {
 		for ep := range c.EndpointConfig.Endpoints {
@@ -290,12 +582,24 @@ func (R *RouteConfig) Free() {
 }
 
 func (R *RouteConfig) GetLocalBestCluster(canary bool) *ClusterConfig {
+	return R.getLocalBestCluster(canary, false, false)
+}
+
+func (R *RouteConfig) GetLocalBestMirror() *ClusterConfig {
+	return R.getLocalBestCluster(false, true, false)
+}
+
+func (R *RouteConfig) GetLocalBestAuthz() *ClusterConfig {
+	return R.getLocalBestCluster(false, false, true)
+}
+
+func (R *RouteConfig) getLocalBestCluster(canary, mirror, authz bool) *ClusterConfig {
 	var bestCluster *ClusterConfig
 	for c := range R.Clusters {
 		_cluster := R.Clusters[c]
 		if _cluster.IsLocalCluster() &&
 			(bestCluster == nil || _cluster.Priority < bestCluster.Priority) &&
-			_cluster.IsCanary == canary {
+			_cluster.IsCanary == canary && _cluster.IsMirror == mirror && _cluster.IsAuthz == authz {
 			bestCluster = _cluster
 		}
 	}
@@ -303,6 +607,34 @@ func (R *RouteConfig) GetLocalBestCluster(canary bool) *ClusterConfig {
 	return bestCluster
 }
 
+// DefaultAuthzConnectTimeout is used until the authorization service is tracked in some zone, in ms
+const DefaultAuthzConnectTimeout = 1000
+
+// GetAuthzConnectTimeout prefers the local zone's authorization cluster, any other zone's one is good enough as they
+// all come from the same PPS
+func (R *RouteConfig) GetAuthzConnectTimeout() int {
+	authzCluster := R.GetLocalBestAuthz()
+	for c := range R.Clusters {
+		if authzCluster == nil && R.Clusters[c].IsAuthz {
+			authzCluster = R.Clusters[c]
+		}
+	}
+
+	if authzCluster == nil || authzCluster.ConnectTimeout <= 0 {
+		return DefaultAuthzConnectTimeout
+	}
+	return authzCluster.ConnectTimeout
+}
+
+func (R *RouteConfig) HasMirror() bool {
+	for c := range R.Clusters {
+		if R.Clusters[c].IsMirror {
+			return true
+		}
+	}
+	return false
+}
+
 func (R *RouteConfig) CalculateWeights() (
 	totalWeight, localZoneWeight, otherZonesWeight, canariesWeight, connectTimeout, maxRequests int) {
 	otherZoneCount := 0
@@ -313,7 +645,7 @@ func (R *RouteConfig) CalculateWeights() (
 	// find the total sum of weights that are not our cluster and our clusters as well
 	for c := range R.Clusters {
 		_cluster := R.Clusters[c]
-		if _cluster.EndpointConfig == nil {
+		if _cluster.EndpointConfig == nil || _cluster.IsMirror || _cluster.IsAuthz {
 			continue
 		}
 		if bestCluster == _cluster {
@@ -348,7 +680,23 @@ func (R *RouteConfig) AddClusters(configs []*ClusterConfig) {
 }
 
 func (R *RouteConfig) GenerateUniqueRouteName() string {
-	return strings.Replace(R.PathPrefix, "/", "-", -1)
+	name := strings.Replace(R.PathPrefix, "/", "-", -1)
+	if suffix := R.Match.GenerateSuffix(); suffix != "" {
+		name = name + "-" + suffix
+	}
+
+	return name
+}
+
+// routes with extra match conditions have to go before plain prefix ones or they would never be hit
+func (V *VirtualHost) GetSortedRoutes() []*RouteConfig {
+	routes := make([]*RouteConfig, len(V.Routes))
+	copy(routes, V.Routes)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return !routes[i].Match.IsEmpty() && routes[j].Match.IsEmpty()
+	})
+
+	return routes
 }
 
 func (L *ListenerConfig) FindVHost(name string) *VirtualHost {
@@ -386,13 +734,364 @@ func (L *ListenerConfig) AddVHosts(hosts []*VirtualHost) {
 }
 
 func (L *ListenerConfig) AddVHost(host *VirtualHost) {
-	if L.FindVHost(host.Name) != nil {
-		L.FindVHost(host.Name).AddRoutes(host.Routes)
+	if vhost := L.FindVHost(host.Name); vhost != nil {
+		vhost.AddRoutes(host.Routes)
+		if vhost.TLSSecret == nil {
+			vhost.TLSSecret = host.TLSSecret
+		} else if host.TLSSecret != nil && host.TLSSecret != vhost.TLSSecret {
+			logrus.Warnf("Vhost %s on listener %s already has a TLS certificate, ignoring the new one", vhost.Name, L.Name)
+		}
+		if vhost.ClientCA == nil {
+			vhost.ClientCA = host.ClientCA
+			vhost.ClientAllowedSANs = host.ClientAllowedSANs
+		} else if host.ClientCA != nil && host.ClientCA != vhost.ClientCA {
+			logrus.Warnf("Vhost %s on listener %s already has a client CA, ignoring the new one", vhost.Name, L.Name)
+		}
 	} else {
 		L.VirtualHosts = append(L.VirtualHosts, host)
 	}
 }
 
+func (L *ListenerConfig) HasFaultInjection() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if L.VirtualHosts[v].Routes[r].Fault != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetAccessLog returns the access log of the first route in order that has one, the daemon default otherwise
+func (L *ListenerConfig) GetAccessLog() *AccessLogConfig {
+	var accessLog *AccessLogConfig
+	sortedVHosts := L.GetSortedVHosts()
+	for v := range sortedVHosts {
+		sortedRoutes := sortedVHosts[v].GetSortedRoutes()
+		for r := range sortedRoutes {
+			routeAccessLog := sortedRoutes[r].AccessLog
+			if routeAccessLog == nil {
+				continue
+			}
+			if accessLog == nil {
+				accessLog = routeAccessLog
+			} else if *accessLog != *routeAccessLog {
+				logrus.Warnf("Conflicting access logs on listener %s, ignoring the one from route %s", L.Name, sortedRoutes[r].Name)
+			}
+		}
+	}
+
+	if accessLog == nil {
+		return DefaultAccessLog
+	}
+	return accessLog
+}
+
+// GetCompression returns the compression of the first route in order that asks for it
+func (L *ListenerConfig) GetCompression() *CompressionConfig {
+	var compression *CompressionConfig
+	sortedVHosts := L.GetSortedVHosts()
+	for v := range sortedVHosts {
+		sortedRoutes := sortedVHosts[v].GetSortedRoutes()
+		for r := range sortedRoutes {
+			routeCompression := sortedRoutes[r].Compression
+			if routeCompression == nil || routeCompression.Disabled {
+				continue
+			}
+			if compression == nil {
+				compression = routeCompression
+			} else if !reflect.DeepEqual(compression, routeCompression) {
+				logrus.Warnf("Conflicting compression on listener %s, ignoring the one from route %s", L.Name, sortedRoutes[r].Name)
+			}
+		}
+	}
+	return compression
+}
+
+// AcceptsProxyProtocol tells whether the clients send the PROXY protocol header, as this can't differ between the routes
+// sharing the listener, the first route in order decides
+func (L *ListenerConfig) AcceptsProxyProtocol() bool {
+	var firstRoute *RouteConfig
+	sortedVHosts := L.GetSortedVHosts()
+	for v := range sortedVHosts {
+		sortedRoutes := sortedVHosts[v].GetSortedRoutes()
+		for r := range sortedRoutes {
+			if firstRoute == nil {
+				firstRoute = sortedRoutes[r]
+			} else if firstRoute.AcceptProxyProtocol != sortedRoutes[r].AcceptProxyProtocol {
+				logrus.Warnf("Conflicting PROXY protocol on listener %s, ignoring the one from route %s", L.Name, sortedRoutes[r].Name)
+			}
+		}
+	}
+	return firstRoute != nil && firstRoute.AcceptProxyProtocol
+}
+
+// GetExtAuthzRoute returns the first route in order that asks for authorization, its service is used by the whole listener
+func (L *ListenerConfig) GetExtAuthzRoute() *RouteConfig {
+	var authzRoute *RouteConfig
+	sortedVHosts := L.GetSortedVHosts()
+	for v := range sortedVHosts {
+		sortedRoutes := sortedVHosts[v].GetSortedRoutes()
+		for r := range sortedRoutes {
+			if sortedRoutes[r].ExtAuthz == nil {
+				continue
+			}
+			if authzRoute == nil {
+				authzRoute = sortedRoutes[r]
+			} else if *authzRoute.ExtAuthz != *sortedRoutes[r].ExtAuthz {
+				logrus.Warnf("Conflicting authorization on listener %s, route %s uses the one of route %s", L.Name, sortedRoutes[r].Name, authzRoute.Name)
+			}
+		}
+	}
+	return authzRoute
+}
+
+func (L *ListenerConfig) HasJWT() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if L.VirtualHosts[v].Routes[r].JWT != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (L *ListenerConfig) HasWebSocket() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if L.VirtualHosts[v].Routes[r].WebSocket {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (L *ListenerConfig) HasCors() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if L.VirtualHosts[v].Routes[r].Cors != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetCors returns the policy shared by the whole vhost, the first route in order wins
+func (V *VirtualHost) GetCors() *CorsConfig {
+	var cors *CorsConfig
+	sortedRoutes := V.GetSortedRoutes()
+	for r := range sortedRoutes {
+		routeCors := sortedRoutes[r].Cors
+		if routeCors == nil || !routeCors.PerVHost {
+			continue
+		}
+		if cors == nil {
+			cors = routeCors
+		} else if !reflect.DeepEqual(cors, routeCors) {
+			logrus.Warnf("Conflicting CORS policies on vhost %s, ignoring the one from route %s", V.Name, sortedRoutes[r].Name)
+		}
+	}
+	return cors
+}
+
+func (L *ListenerConfig) HasGlobalRateLimit() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if len(L.VirtualHosts[v].Routes[r].RateLimitDescriptors) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (L *ListenerConfig) HasLocalRateLimit() bool {
+	for v := range L.VirtualHosts {
+		for r := range L.VirtualHosts[v].Routes {
+			if L.VirtualHosts[v].Routes[r].RateLimit != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetListenerRateLimit finds the rate limit shared by the whole listener, the first route in order wins
+func (L *ListenerConfig) GetListenerRateLimit() *LocalRateLimitConfig {
+	var rateLimit *LocalRateLimitConfig
+	sortedVHosts := L.GetSortedVHosts()
+	for v := range sortedVHosts {
+		sortedRoutes := sortedVHosts[v].GetSortedRoutes()
+		for r := range sortedRoutes {
+			routeRateLimit := sortedRoutes[r].RateLimit
+			if routeRateLimit == nil || (L.Type == HTTP && !routeRateLimit.PerListener) {
+				continue
+			}
+			if rateLimit == nil {
+				rateLimit = routeRateLimit
+			} else if *rateLimit != *routeRateLimit {
+				logrus.Warnf("Conflicting rate limits on listener %s, ignoring the one from route %s", L.Name, sortedRoutes[r].Name)
+			}
+		}
+	}
+	return rateLimit
+}
+
+func mergeHeaderValues(into, from []*HeaderValueConfig) []*HeaderValueConfig {
+	for f := range from {
+		found := false
+		for i := range into {
+			if strings.EqualFold(into[i].Name, from[f].Name) {
+				found = true
+				if *into[i] != *from[f] {
+					logrus.Warnf("Header %s is already set to %s, ignoring %s", into[i].Name, into[i].Value, from[f].Value)
+				}
+				break
+			}
+		}
+		if !found {
+			into = append(into, from[f])
+		}
+	}
+	return into
+}
+
+func mergeHeaderNames(into, from []string) []string {
+	for f := range from {
+		found := false
+		for i := range into {
+			if strings.EqualFold(into[i], from[f]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			into = append(into, from[f])
+		}
+	}
+	return into
+}
+
+// Merge adds headers of the other config, headers that are already set keep their value
+func (H *HeadersConfig) Merge(other *HeadersConfig) {
+	if other == nil {
+		return
+	}
+	H.RequestHeadersToAdd = mergeHeaderValues(H.RequestHeadersToAdd, other.RequestHeadersToAdd)
+	H.RequestHeadersToRemove = mergeHeaderNames(H.RequestHeadersToRemove, other.RequestHeadersToRemove)
+	H.ResponseHeadersToAdd = mergeHeaderValues(H.ResponseHeadersToAdd, other.ResponseHeadersToAdd)
+	H.ResponseHeadersToRemove = mergeHeaderNames(H.ResponseHeadersToRemove, other.ResponseHeadersToRemove)
+}
+
+// GetHeaders merges the vhost headers of all routes, the routes in order win
+func (V *VirtualHost) GetHeaders() *HeadersConfig {
+	headers := &HeadersConfig{}
+	sortedRoutes := V.GetSortedRoutes()
+	for r := range sortedRoutes {
+		headers.Merge(sortedRoutes[r].VHostHeaders)
+	}
+	return headers
+}
+
+// GetSortedVHosts returns vhosts ordered by name with the catch-all one last, so the output doesn't depend on PPS order
+func (L *ListenerConfig) GetSortedVHosts() []*VirtualHost {
+	vhosts := make([]*VirtualHost, len(L.VirtualHosts))
+	copy(vhosts, L.VirtualHosts)
+	sort.SliceStable(vhosts, func(i, j int) bool {
+		if vhosts[i].Name == "*" || vhosts[j].Name == "*" {
+			return vhosts[j].Name == "*" && vhosts[i].Name != "*"
+		}
+		return vhosts[i].Name < vhosts[j].Name
+	})
+
+	return vhosts
+}
+
+// GetVHostDomains maps vhost names to the domains they are allowed to serve. Envoy refuses the whole route config
+// when a domain is present in more than one vhost, so the first vhost in sorted order keeps it and the rest lose it.
+func (L *ListenerConfig) GetVHostDomains() map[string][]string {
+	vhostDomains := map[string][]string{}
+	claimedBy := map[string]string{}
+
+	vhosts := L.GetSortedVHosts()
+	for v := range vhosts {
+		vhostDomains[vhosts[v].Name] = []string{}
+		for d := range vhosts[v].Domains {
+			domain := vhosts[v].Domains[d]
+			if owner, ok := claimedBy[domain]; ok {
+				logrus.Warnf("Domain %s of vhost %s on listener %s is already served by vhost %s, ignoring it",
+					domain, vhosts[v].Name, L.Name, owner)
+				continue
+			}
+
+			claimedBy[domain] = vhosts[v].Name
+			vhostDomains[vhosts[v].Name] = append(vhostDomains[vhosts[v].Name], domain)
+		}
+	}
+
+	return vhostDomains
+}
+
+// VHostDomains is a run of domains served by the same vhost
+type VHostDomains struct {
+	VHost   *VirtualHost
+	Domains []string
+}
+
+// domainPrecedence ranks the domain the way envoy looks for the vhost of a request
+func domainPrecedence(domain string) int {
+	switch {
+	case domain == "*":
+		return 3
+	case strings.HasPrefix(domain, "*"):
+		return 1
+	case strings.HasSuffix(domain, "*"):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// GetVHostDomainsByPrecedence orders the domains the way envoy picks the vhost serving a request: exact domains first,
+// then the suffix and the prefix wildcards, both longest first, and the catch-all last. Neighbouring domains of one
+// vhost are grouped together.
+func (L *ListenerConfig) GetVHostDomainsByPrecedence() []*VHostDomains {
+	vhostDomains := L.GetVHostDomains()
+	domainVHosts := map[string]*VirtualHost{}
+	var domains []string
+
+	vhosts := L.GetSortedVHosts()
+	for v := range vhosts {
+		for _, domain := range vhostDomains[vhosts[v].Name] {
+			domainVHosts[domain] = vhosts[v]
+			domains = append(domains, domain)
+		}
+	}
+
+	sort.SliceStable(domains, func(i, j int) bool {
+		if domainPrecedence(domains[i]) != domainPrecedence(domains[j]) {
+			return domainPrecedence(domains[i]) < domainPrecedence(domains[j])
+		}
+		return len(domains[i]) > len(domains[j])
+	})
+
+	var grouped []*VHostDomains
+	for d := range domains {
+		vhost := domainVHosts[domains[d]]
+		if len(grouped) != 0 && grouped[len(grouped)-1].VHost == vhost {
+			grouped[len(grouped)-1].Domains = append(grouped[len(grouped)-1].Domains, domains[d])
+			continue
+		}
+		grouped = append(grouped, &VHostDomains{VHost: vhost, Domains: []string{domains[d]}})
+	}
+
+	return grouped
+}
+
 func (L *ListenerConfig) IsTrackedBy(zone string) bool {
 	L.mu.Lock()
 	defer L.mu.Unlock()
@@ -545,6 +1244,14 @@ func (L *ListenerConfig) GenerateListenParts() (host string, port int64) {
 	return
 }
 
+func GenerateJWTProviderName(vhost *VirtualHost, route *RouteConfig) string {
+	return vhost.Name + "_" + route.GenerateUniqueRouteName()
+}
+
+func GenerateAuthzClusterName(listenerName string) string {
+	return listenerName + "-authz"
+}
+
 func GenerateListenerName(listen string, xtype ProxyType) string {
 	return strings.Replace(listen, ":", "-", -1) + "_" + fmt.Sprintf("%d", xtype)
 }
@@ -553,7 +1260,16 @@ func GenerateVHostName(domains []string) string {
 	return strings.Join(domains, "-")
 }
 
-func GenerateRouteName(pathSpec string) (string, string) {
+// GenerateClusterName names the local cluster of a route, the catch-all vhost is left out to keep the old names
+func GenerateClusterName(listenerName string, vhost *VirtualHost, route *RouteConfig) string {
+	if vhost.Name == "*" {
+		return listenerName + "_" + route.GenerateUniqueRouteName()
+	}
+
+	return listenerName + "_" + vhost.Name + "_" + route.GenerateUniqueRouteName()
+}
+
+func GenerateRouteName(pathSpec string, match *MatchConfig) (string, string) {
 	path := "/"
 	if pathSpec != "" {
 		path = pathSpec
@@ -562,7 +1278,27 @@ func GenerateRouteName(pathSpec string) (string, string) {
 		path = "/" + path
 	}
 
-	return strings.Replace(path, "/", "_", -1), path
+	name := strings.Replace(path, "/", "_", -1)
+	if suffix := match.GenerateSuffix(); suffix != "" {
+		name = name + "_" + suffix
+	}
+
+	return name, path
+}
+
+func (M *MatchConfig) IsEmpty() bool {
+	return M == nil || (M.Path == "" && M.Regex == "" && len(M.Headers) == 0 && len(M.QueryParameters) == 0)
+}
+
+// GenerateSuffix returns a stable hash of the match so routes sharing a path prefix don't collide
+func (M *MatchConfig) GenerateSuffix() string {
+	if M.IsEmpty() {
+		return ""
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(M.String()))
+	return fmt.Sprintf("%08x", hash.Sum32())
 }
 
 type Locality struct {
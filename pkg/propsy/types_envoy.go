@@ -1,7 +1,9 @@
 package propsy
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
@@ -9,12 +11,26 @@ import (
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	fault "github.com/envoyproxy/go-control-plane/envoy/config/filter/fault/v2"
+	extauthz "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
+	faultfilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/fault/v2"
+	gzip "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/gzip/v2"
+	jwtauthn "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	ratelimitfilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rate_limit/v2"
 	v22 "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	v23 "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v2"
+	_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"github.com/sirupsen/logrus"
 	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -64,15 +80,36 @@ func (L *Locality) ToEnvoy() *core.Locality {
 }
 
 func (C *ClusterConfig) ToEnvoy() *v2.Cluster {
-	return ClusterToEnvoy(C.Name, C.ConnectTimeout, C.MaxRequests, C.HealthCheck, C.Outlier)
+	return ClusterToEnvoy(C.Name, C.ConnectTimeout, C.MaxRequests, C.HealthCheck, C.Outlier, C.UpstreamTLS, C.CircuitBreakers, C.LBPolicy, C.UpstreamProtocol, C.ProxyProtocol)
 }
 
 func (V *VirtualHost) ToEnvoy(routes []*route.Route) *route.VirtualHost {
+	headers := V.GetHeaders()
+
 	return &route.VirtualHost{
-		Name:    V.Name,
-		Domains: V.Domains,
-		Routes:  routes,
+		Name:                    V.Name,
+		Domains:                 V.Domains,
+		Routes:                  routes,
+		Cors:                    V.GetCors().ToEnvoy(),
+		RequestHeadersToAdd:     HeaderValuesToEnvoy(headers.RequestHeadersToAdd),
+		RequestHeadersToRemove:  headers.RequestHeadersToRemove,
+		ResponseHeadersToAdd:    HeaderValuesToEnvoy(headers.ResponseHeadersToAdd),
+		ResponseHeadersToRemove: headers.ResponseHeadersToRemove,
+	}
+}
+
+func HeaderValuesToEnvoy(headers []*HeaderValueConfig) []*core.HeaderValueOption {
+	var options []*core.HeaderValueOption
+	for i := range headers {
+		options = append(options, &core.HeaderValueOption{
+			Header: &core.HeaderValue{
+				Key:   headers[i].Name,
+				Value: headers[i].Value,
+			},
+			Append: &types.BoolValue{Value: headers[i].Append},
+		})
 	}
+	return options
 }
 
 func WeightedClusterToEnvoy(clusterName string, zoneWeight int) *route.WeightedCluster_ClusterWeight {
@@ -92,26 +129,180 @@ func (L *ListenerConfig) GenerateHCM(vhosts []*route.VirtualHost) *v22.HttpConne
 				VirtualHosts: vhosts,
 			},
 		},
-		HttpFilters: []*v22.HttpFilter{
-			{
-				Name: "envoy.router",
+		HttpFilters:    L.GenerateHTTPFilters(),
+		AccessLog:      L.GenerateAccessLogs(),
+		UpgradeConfigs: L.GenerateUpgradeConfigs(),
+	}
+}
+
+// GenerateHCMFilter wraps the connection manager routing the vhosts into a listener filter
+func (L *ListenerConfig) GenerateHCMFilter(vhosts []*route.VirtualHost) (*listener.Filter, error) {
+	filterConfig, err := util.MessageToStruct(L.GenerateHCM(vhosts))
+	if err != nil {
+		return nil, err
+	}
+
+	return &listener.Filter{
+		Name: util.HTTPConnectionManager,
+		ConfigType: &listener.Filter_Config{
+			Config: filterConfig,
+		},
+	}, nil
+}
+
+// WebSocketUpgrade is the upgrade type of websocket connections
+const WebSocketUpgrade = "websocket"
+
+// GenerateUpgradeConfigs allows websockets on the listener, they stay disabled unless a route enables them
+func (L *ListenerConfig) GenerateUpgradeConfigs() []*v22.HttpConnectionManager_UpgradeConfig {
+	if !L.HasWebSocket() {
+		return nil
+	}
+
+	return []*v22.HttpConnectionManager_UpgradeConfig{{
+		UpgradeType: WebSocketUpgrade,
+		Enabled:     &types.BoolValue{Value: false},
+	}}
+}
+
+// GenerateHTTPFilters returns the filters needed by the routes of this listener, router always goes last
+func (L *ListenerConfig) GenerateHTTPFilters() []*v22.HttpFilter {
+	var filters []*v22.HttpFilter
+
+	if L.HasCors() {
+		// answers preflight requests before they get rate limited, the policies are set on routes and vhosts
+		filters = append(filters, &v22.HttpFilter{
+			Name: util.CORS,
+			ConfigType: &v22.HttpFilter_Config{
+				Config: nil,
+			},
+		})
+	}
+
+	if L.HasJWT() {
+		filterConfig, err := util.MessageToStruct(L.GenerateJWTAuthentication())
+		if err != nil {
+			logrus.Warnf("Error generating JWT filter for listener %s: %s", L.Name, err.Error())
+		} else {
+			filters = append(filters, &v22.HttpFilter{
+				Name: JWTAuthnHTTPFilter,
+				ConfigType: &v22.HttpFilter_Config{
+					Config: filterConfig,
+				},
+			})
+		}
+	}
+
+	if authzRoute := L.GetExtAuthzRoute(); authzRoute != nil {
+		filterConfig, err := util.MessageToStruct(authzRoute.ExtAuthz.ToEnvoy(GenerateAuthzClusterName(L.Name)))
+		if err != nil {
+			logrus.Warnf("Error generating authorization filter for listener %s: %s", L.Name, err.Error())
+		} else {
+			filters = append(filters, &v22.HttpFilter{
+				Name: util.HTTPExternalAuthorization,
 				ConfigType: &v22.HttpFilter_Config{
-					Config: nil,
+					Config: filterConfig,
 				},
+			})
+		}
+	}
+
+	if L.HasLocalRateLimit() {
+		// routes without their own limit fall back to the listener one, if there is any
+		filters = append(filters, &v22.HttpFilter{
+			Name: LocalRateLimitHTTPFilter,
+			ConfigType: &v22.HttpFilter_Config{
+				Config: L.GetListenerRateLimit().ToEnvoyHTTP(L.Name),
 			},
-		},
+		})
+	}
+
+	if RateLimitCluster != "" && L.HasGlobalRateLimit() {
+		filterConfig, err := util.MessageToStruct(GenerateGlobalRateLimit())
+		if err != nil {
+			logrus.Warnf("Error generating rate limit filter for listener %s: %s", L.Name, err.Error())
+		} else {
+			filters = append(filters, &v22.HttpFilter{
+				Name: util.HTTPRateLimit,
+				ConfigType: &v22.HttpFilter_Config{
+					Config: filterConfig,
+				},
+			})
+		}
+	}
+
+	if L.HasFaultInjection() {
+		// the filter itself does nothing, faults are configured per route
+		filters = append(filters, &v22.HttpFilter{
+			Name: util.Fault,
+			ConfigType: &v22.HttpFilter_Config{
+				Config: nil,
+			},
+		})
+	}
+
+	if compression := L.GetCompression(); compression != nil {
+		filterConfig, err := util.MessageToStruct(compression.ToEnvoy())
+		if err != nil {
+			logrus.Warnf("Error generating gzip filter for listener %s: %s", L.Name, err.Error())
+		} else {
+			filters = append(filters, &v22.HttpFilter{
+				Name: util.Gzip,
+				ConfigType: &v22.HttpFilter_Config{
+					Config: filterConfig,
+				},
+			})
+		}
 	}
+
+	filters = append(filters, &v22.HttpFilter{
+		Name: util.Router,
+		ConfigType: &v22.HttpFilter_Config{
+			Config: nil,
+		},
+	})
+
+	return filters
 }
 
+// GenerateWeightedCluster splits the connections just like the HTTP routes split the requests between the local zone,
+// the other zones and the local canary. A tcp proxy has no routes, so only the first route of the vhost is used.
 func (L *ListenerConfig) GenerateWeightedCluster(host *route.VirtualHost) *v23.TcpProxy_WeightedClusters {
+	var routedClusters []*route.WeightedCluster_ClusterWeight
+	if len(host.Routes) > 0 {
+		if len(host.Routes) > 1 {
+			logrus.Warnf("TCP vhost %s on listener %s can proxy to a single service only, using the first one", host.Name, L.Name)
+		}
+		routedClusters = host.Routes[0].GetRoute().GetWeightedClusters().GetClusters()
+	}
+
+	var clusters []*v23.TcpProxy_WeightedCluster_ClusterWeight
+	for i := range routedClusters {
+		weight := routedClusters[i].GetWeight().GetValue()
+		if weight == 0 {
+			continue // tcp proxy refuses clusters without any weight
+		}
+		clusters = append(clusters, &v23.TcpProxy_WeightedCluster_ClusterWeight{
+			Name:   routedClusters[i].Name,
+			Weight: weight,
+		})
+	}
+
+	// without any weight, everything goes to the local zone cluster, which fails over to the other zones by itself
+	if len(clusters) == 0 {
+		clusterName := host.Name
+		if len(routedClusters) > 0 {
+			clusterName = routedClusters[0].Name
+		}
+		clusters = append(clusters, &v23.TcpProxy_WeightedCluster_ClusterWeight{
+			Name:   clusterName,
+			Weight: 1,
+		})
+	}
+
 	return &v23.TcpProxy_WeightedClusters{
 		WeightedClusters: &v23.TcpProxy_WeightedCluster{
-			Clusters: []*v23.TcpProxy_WeightedCluster_ClusterWeight{
-				{
-					Name:   host.Name,
-					Weight: uint32(1), // TODO
-				},
-			},
+			Clusters: clusters,
 		},
 	}
 }
@@ -120,7 +311,16 @@ func (L *ListenerConfig) GenerateTCP(clusters *v23.TcpProxy_WeightedClusters) *v
 	return &v23.TcpProxy{
 		StatPrefix:       L.Name,
 		ClusterSpecifier: clusters,
+		AccessLog:        L.GenerateAccessLogs(),
+	}
+}
+
+func (L *ListenerConfig) GenerateAccessLogs() []*accesslog.AccessLog {
+	accessLog := L.GetAccessLog()
+	if !accessLog.IsEnabled() {
+		return nil
 	}
+	return accessLog.ToEnvoy(L.Name, L.Type)
 }
 
 type ClusterLoadAssignment []*endpoint.LocalityLbEndpoints
@@ -133,12 +333,26 @@ func (C *ClusterLoadAssignment) ToEnvoy(clusterName string) *v2.ClusterLoadAssig
 }
 
 func (R *RouteConfig) GeneratePrioritizedEndpoints(localZone string) ClusterLoadAssignment {
+	return R.generatePrioritizedEndpoints(false, false)
+}
+
+// GenerateMirrorEndpoints prioritizes the mirror service endpoints the same way as the primary ones
+func (R *RouteConfig) GenerateMirrorEndpoints() ClusterLoadAssignment {
+	return R.generatePrioritizedEndpoints(true, false)
+}
+
+// GenerateAuthzEndpoints prioritizes the authorization service endpoints the same way as the primary ones
+func (R *RouteConfig) GenerateAuthzEndpoints() ClusterLoadAssignment {
+	return R.generatePrioritizedEndpoints(false, true)
+}
+
+func (R *RouteConfig) generatePrioritizedEndpoints(mirror, authz bool) ClusterLoadAssignment {
 	var endpoints []*endpoint.LocalityLbEndpoints
 
 	// find the lowest local priority
 	lowestPriority := math.MaxInt32
 	for c := range R.Clusters {
-		if R.Clusters[c].Priority < lowestPriority && !R.Clusters[c].IsCanary && R.Clusters[c].EndpointConfig.Endpoints != nil && R.Clusters[c].IsLocalCluster() {
+		if R.Clusters[c].Priority < lowestPriority && !R.Clusters[c].IsCanary && R.Clusters[c].IsMirror == mirror && R.Clusters[c].IsAuthz == authz && R.Clusters[c].EndpointConfig.Endpoints != nil && R.Clusters[c].IsLocalCluster() {
 			lowestPriority = R.Clusters[c].Priority
 		}
 	}
@@ -146,7 +360,7 @@ func (R *RouteConfig) GeneratePrioritizedEndpoints(localZone string) ClusterLoad
 	for c := range R.Clusters {
 		_cluster := R.Clusters[c]
 		// skip canaries for this
-		if _cluster.IsCanary {
+		if _cluster.IsCanary || _cluster.IsMirror != mirror || _cluster.IsAuthz != authz {
 			continue
 		}
 
@@ -221,7 +435,353 @@ func (O *OutlierConfig) ToEnvoy() *cluster.OutlierDetection {
 	}
 }
 
-func ClusterToEnvoy(targetName string, connectTimeout, maxRequests int, healthCheck *HealthCheckConfig, outlier *OutlierConfig) *v2.Cluster {
+func (L LBPolicy) ToEnvoy() v2.Cluster_LbPolicy {
+	switch L {
+	case LeastRequestLB:
+		return v2.Cluster_LEAST_REQUEST
+	case RingHashLB:
+		return v2.Cluster_RING_HASH
+	case RandomLB:
+		return v2.Cluster_RANDOM
+	case MaglevLB:
+		return v2.Cluster_MAGLEV
+	default:
+		return v2.Cluster_ROUND_ROBIN
+	}
+}
+
+// JWTAuthnHTTPFilter is missing in the util package
+const JWTAuthnHTTPFilter = "envoy.filters.http.jwt_authn"
+
+// GenerateJWTAuthentication mirrors the routes of the listener in the filter rules, as the filter matches requests
+// on its own. Routes without JWT get a rule too, so they are not caught by a less specific route requiring it. The
+// rules follow the domains in the order envoy picks the vhosts, so a wildcard vhost can't shadow a more specific one.
+func (L *ListenerConfig) GenerateJWTAuthentication() *jwtauthn.JwtAuthentication {
+	jwtAuthentication := &jwtauthn.JwtAuthentication{
+		Providers: map[string]*jwtauthn.JwtProvider{},
+	}
+
+	vhostDomains := L.GetVHostDomainsByPrecedence()
+	for v := range vhostDomains {
+		vhost := vhostDomains[v].VHost
+		sortedRoutes := vhost.GetSortedRoutes()
+		for r := range sortedRoutes {
+			rule := &jwtauthn.RequirementRule{
+				Match: sortedRoutes[r].Match.ToEnvoy(sortedRoutes[r].PathPrefix),
+			}
+			if authority := GenerateAuthorityMatch(vhostDomains[v].Domains); authority != nil {
+				rule.Match.Headers = append(rule.Match.Headers, authority)
+			}
+
+			if sortedRoutes[r].JWT != nil {
+				providerName := GenerateJWTProviderName(vhost, sortedRoutes[r])
+				jwtAuthentication.Providers[providerName] = sortedRoutes[r].JWT.ToEnvoy()
+				rule.Requires = &jwtauthn.JwtRequirement{
+					RequiresType: &jwtauthn.JwtRequirement_ProviderName{ProviderName: providerName},
+				}
+			}
+
+			jwtAuthentication.Rules = append(jwtAuthentication.Rules, rule)
+		}
+	}
+
+	return jwtAuthentication
+}
+
+// GenerateAuthorityMatch matches requests of the given vhost domains, nil for the catch-all vhost
+func GenerateAuthorityMatch(domains []string) *route.HeaderMatcher {
+	var patterns []string
+	for i := range domains {
+		if domains[i] == "*" {
+			return nil
+		}
+		patterns = append(patterns, strings.Replace(regexp.QuoteMeta(domains[i]), `\*`, ".*", -1))
+	}
+
+	return &route.HeaderMatcher{
+		Name:                 ":authority",
+		HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{RegexMatch: "(" + strings.Join(patterns, "|") + ")(:[0-9]+)?"},
+	}
+}
+
+func (J *JWTConfig) ToEnvoy() *jwtauthn.JwtProvider {
+	provider := &jwtauthn.JwtProvider{
+		Issuer:               J.Issuer,
+		Audiences:            J.Audiences,
+		Forward:              J.Forward,
+		ForwardPayloadHeader: J.ForwardPayloadHeader,
+	}
+
+	if J.RemoteJWKSURI != "" {
+		timeout := time.Second
+		provider.JwksSourceSpecifier = &jwtauthn.JwtProvider_RemoteJwks{
+			RemoteJwks: &jwtauthn.RemoteJwks{
+				HttpUri: &core.HttpUri{
+					Uri:              J.RemoteJWKSURI,
+					HttpUpstreamType: &core.HttpUri_Cluster{Cluster: J.RemoteJWKSCluster},
+					Timeout:          &timeout,
+				},
+			},
+		}
+		return provider
+	}
+
+	var jwks string
+	if J.JWKS != nil {
+		jwks = string(J.JWKS.JWKS)
+	}
+	if jwks == "" {
+		logrus.Warnf("There are no JWT keys for issuer %s", J.Issuer)
+	}
+	provider.JwksSourceSpecifier = &jwtauthn.JwtProvider_LocalJwks{
+		LocalJwks: &core.DataSource{
+			Specifier: &core.DataSource_InlineString{InlineString: jwks},
+		},
+	}
+
+	return provider
+}
+
+func (E *ExtAuthzConfig) ToEnvoy(clusterName string) *extauthz.ExtAuthz {
+	extAuthz := &extauthz.ExtAuthz{
+		FailureModeAllow: E.FailureModeAllow,
+	}
+
+	timeout := E.Timeout
+	if E.GRPC {
+		extAuthz.Services = &extauthz.ExtAuthz_GrpcService{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: clusterName},
+				},
+				Timeout: DurationToDuration(timeout),
+			},
+		}
+	} else {
+		extAuthz.Services = &extauthz.ExtAuthz_HttpService{
+			HttpService: &extauthz.HttpService{
+				ServerUri: &core.HttpUri{
+					Uri:              "http://" + clusterName,
+					HttpUpstreamType: &core.HttpUri_Cluster{Cluster: clusterName},
+					Timeout:          &timeout,
+				},
+				PathPrefix: E.PathPrefix,
+			},
+		}
+	}
+
+	return extAuthz
+}
+
+// DisableExtAuthz lets the route through without asking the authorization service of the listener
+func DisableExtAuthz(envoyRoute *route.Route) {
+	if envoyRoute.PerFilterConfig == nil {
+		envoyRoute.PerFilterConfig = map[string]*types.Struct{}
+	}
+	envoyRoute.PerFilterConfig[util.HTTPExternalAuthorization] = DisabledExtAuthz()
+}
+
+// DisableCompression marks the responses of the route as no-transform, the gzip filter of the listener has no per-route
+// config but leaves such responses alone. The directive is added next to the cache-control the service sends.
+func DisableCompression(envoyRoute *route.Route) {
+	envoyRoute.ResponseHeadersToAdd = append(envoyRoute.ResponseHeadersToAdd, &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: "cache-control", Value: "no-transform"},
+		Append: &types.BoolValue{Value: true},
+	})
+}
+
+// DisabledExtAuthz turns the authorization off for routes that don't ask for it
+func DisabledExtAuthz() *types.Struct {
+	perRoute, err := util.MessageToStruct(&extauthz.ExtAuthzPerRoute{
+		Override: &extauthz.ExtAuthzPerRoute_Disabled{Disabled: true},
+	})
+	if err != nil {
+		logrus.Warnf("Error generating authorization override: %s", err.Error())
+	}
+	return perRoute
+}
+
+func (C CompressionLevel) ToEnvoy() gzip.Gzip_CompressionLevel_Enum {
+	switch C {
+	case BestCompression:
+		return gzip.Gzip_CompressionLevel_BEST
+	case FastestCompression:
+		return gzip.Gzip_CompressionLevel_SPEED
+	default:
+		return gzip.Gzip_CompressionLevel_DEFAULT
+	}
+}
+
+func (C *CompressionConfig) ToEnvoy() *gzip.Gzip {
+	return &gzip.Gzip{
+		ContentLength:    OptionalUInt32FromInteger(C.MinLength),
+		CompressionLevel: C.Level.ToEnvoy(),
+		ContentType:      C.ContentTypes,
+	}
+}
+
+func (H *HashPolicyConfig) ToEnvoy() *route.RouteAction_HashPolicy {
+	hashPolicy := &route.RouteAction_HashPolicy{
+		Terminal: H.Terminal,
+	}
+
+	switch {
+	case H.Header != "":
+		hashPolicy.PolicySpecifier = &route.RouteAction_HashPolicy_Header_{
+			Header: &route.RouteAction_HashPolicy_Header{HeaderName: H.Header},
+		}
+	case H.Cookie != "":
+		cookie := &route.RouteAction_HashPolicy_Cookie{
+			Name: H.Cookie,
+			Path: H.CookiePath,
+		}
+		if H.CookieTTL > 0 {
+			cookie.Ttl = &H.CookieTTL
+		}
+		hashPolicy.PolicySpecifier = &route.RouteAction_HashPolicy_Cookie_{Cookie: cookie}
+	case H.SourceIP:
+		hashPolicy.PolicySpecifier = &route.RouteAction_HashPolicy_ConnectionProperties_{
+			ConnectionProperties: &route.RouteAction_HashPolicy_ConnectionProperties{SourceIp: true},
+		}
+	default:
+		return nil
+	}
+
+	return hashPolicy
+}
+
+func (R *RouteConfig) GenerateMirrorPolicy(mirrorClusterName string) *route.RouteAction_RequestMirrorPolicy {
+	mirror := R.GetLocalBestMirror()
+	if mirror == nil {
+		return nil
+	}
+	if mirror.Weight <= 0 {
+		logrus.Warnf("Mirror %s of route %s gets no requests", mirror.Name, R.Name)
+		return nil
+	}
+
+	return &route.RouteAction_RequestMirrorPolicy{
+		Cluster: mirrorClusterName,
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: PercentToEnvoy(mirror.Weight),
+		},
+	}
+}
+
+func (R *RouteConfig) GenerateHashPolicies() []*route.RouteAction_HashPolicy {
+	var hashPolicies []*route.RouteAction_HashPolicy
+	for i := range R.HashPolicies {
+		hashPolicy := R.HashPolicies[i].ToEnvoy()
+		if hashPolicy == nil {
+			logrus.Warnf("Skipping empty hash policy on route %s", R.Name)
+			continue
+		}
+		hashPolicies = append(hashPolicies, hashPolicy)
+	}
+	return hashPolicies
+}
+
+func (T *CircuitBreakerThresholds) ToEnvoy(priority core.RoutingPriority) *cluster.CircuitBreakers_Thresholds {
+	thresholds := &cluster.CircuitBreakers_Thresholds{
+		Priority:           priority,
+		MaxConnections:     OptionalUInt32FromInteger(T.MaxConnections),
+		MaxPendingRequests: OptionalUInt32FromInteger(T.MaxPendingRequests),
+		MaxRequests:        OptionalUInt32FromInteger(T.MaxRequests),
+		MaxRetries:         OptionalUInt32FromInteger(T.MaxRetries),
+	}
+
+	if T.RetryBudgetPercent > 0 {
+		retryBudget, err := T.GenerateRetryBudget()
+		if err != nil {
+			logrus.Warnf("Error generating retry budget: %s", err.Error())
+		}
+		thresholds.XXX_unrecognized = retryBudget
+	}
+
+	return thresholds
+}
+
+// RetryBudgetField is the number of the retry_budget field of the thresholds, which the vendored API predates
+const RetryBudgetField = 8
+
+// GenerateRetryBudget encodes the retry budget by hand as an unknown field of the thresholds, envoy decodes it the same
+// way as if it was built from the generated API
+func (T *CircuitBreakerThresholds) GenerateRetryBudget() ([]byte, error) {
+	budgetPercent, err := proto.Marshal(&_type.Percent{Value: float64(T.RetryBudgetPercent)})
+	if err != nil {
+		return nil, err
+	}
+
+	retryBudget := proto.NewBuffer(nil)
+	_ = retryBudget.EncodeVarint(1<<3 | proto.WireBytes) // budget_percent
+	_ = retryBudget.EncodeRawBytes(budgetPercent)
+	if minRetryConcurrency := OptionalUInt32FromInteger(T.MinRetryConcurrency); minRetryConcurrency != nil {
+		concurrency, err := proto.Marshal(minRetryConcurrency)
+		if err != nil {
+			return nil, err
+		}
+		_ = retryBudget.EncodeVarint(2<<3 | proto.WireBytes) // min_retry_concurrency
+		_ = retryBudget.EncodeRawBytes(concurrency)
+	}
+
+	thresholds := proto.NewBuffer(nil)
+	_ = thresholds.EncodeVarint(RetryBudgetField<<3 | proto.WireBytes)
+	_ = thresholds.EncodeRawBytes(retryBudget.Bytes())
+	return thresholds.Bytes(), nil
+}
+
+func (C *CircuitBreakersConfig) ToEnvoy() *cluster.CircuitBreakers {
+	if C == nil {
+		return nil
+	}
+
+	circuitBreakers := &cluster.CircuitBreakers{}
+	if C.Default != nil {
+		circuitBreakers.Thresholds = append(circuitBreakers.Thresholds, C.Default.ToEnvoy(core.RoutingPriority_DEFAULT))
+	}
+	if C.High != nil {
+		circuitBreakers.Thresholds = append(circuitBreakers.Thresholds, C.High.ToEnvoy(core.RoutingPriority_HIGH))
+	}
+
+	return circuitBreakers
+}
+
+func (U *UpstreamTLSConfig) ToEnvoy() *auth.UpstreamTlsContext {
+	if U == nil {
+		return nil
+	}
+
+	tlsContext := &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{},
+		Sni:              U.SNI,
+	}
+
+	if U.CA != nil {
+		if !U.CA.HasCA() {
+			logrus.Warnf("There is no CA in %s yet, envoy will wait for it", U.CA.Name)
+		}
+		tlsContext.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{
+				Name:      U.CA.GenerateCASecretName(),
+				SdsConfig: XDSConfigSource(),
+			},
+		}
+	}
+
+	if U.Certificate != nil {
+		if !U.Certificate.IsValid() {
+			logrus.Warnf("There is no client certificate in %s yet, envoy will wait for it", U.Certificate.Name)
+		}
+		tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs = []*auth.SdsSecretConfig{{
+			Name:      U.Certificate.Name,
+			SdsConfig: XDSConfigSource(),
+		}}
+	}
+
+	return tlsContext
+}
+
+func ClusterToEnvoy(targetName string, connectTimeout, maxRequests int, healthCheck *HealthCheckConfig, outlier *OutlierConfig, upstreamTLS *UpstreamTLSConfig, circuitBreakers *CircuitBreakersConfig, lbPolicy LBPolicy, upstreamProtocol UpstreamProtocol, proxyProtocol ProxyProtocolVersion) *v2.Cluster {
 	maxRequestsPtr := UInt32FromInteger(maxRequests)
 	if maxRequests == 0 {
 		maxRequestsPtr = nil
@@ -235,7 +795,7 @@ func ClusterToEnvoy(targetName string, connectTimeout, maxRequests int, healthCh
 
 	connectTimeoutDuration := time.Duration(connectTimeout) * time.Millisecond
 
-	return &v2.Cluster{
+	cluster := &v2.Cluster{
 		Name:           targetName,
 		ConnectTimeout: &connectTimeoutDuration,
 		ClusterDiscoveryType: &v2.Cluster_Type{
@@ -243,20 +803,7 @@ func ClusterToEnvoy(targetName string, connectTimeout, maxRequests int, healthCh
 		},
 		EdsClusterConfig: &v2.Cluster_EdsClusterConfig{
 			ServiceName: targetName,
-			EdsConfig: &core.ConfigSource{
-				ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
-					ApiConfigSource: &core.ApiConfigSource{
-						ApiType: core.ApiConfigSource_GRPC,
-						GrpcServices: []*core.GrpcService{{
-							TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
-								EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
-									ClusterName: "xds_cluster", // todo decide how this gets discovered
-								},
-							},
-						}},
-					},
-				},
-			},
+			EdsConfig:   XDSConfigSource(),
 		},
 		CommonLbConfig: &v2.Cluster_CommonLbConfig{
 			LocalityConfigSpecifier: &v2.Cluster_CommonLbConfig_ZoneAwareLbConfig_{
@@ -268,69 +815,97 @@ func ClusterToEnvoy(targetName string, connectTimeout, maxRequests int, healthCh
 		MaxRequestsPerConnection: maxRequestsPtr,
 		HealthChecks:             hcs,
 		OutlierDetection:         outlier.ToEnvoy(),
+		TlsContext:               upstreamTLS.ToEnvoy(),
+		CircuitBreakers:          circuitBreakers.ToEnvoy(),
+		LbPolicy:                 lbPolicy.ToEnvoy(),
+	}
+
+	switch upstreamProtocol {
+	case HTTP2Upstream:
+		cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	case AutoUpstream:
+		// http2 options are required to use the downstream protocol
+		cluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+		cluster.ProtocolSelection = v2.Cluster_USE_DOWNSTREAM_PROTOCOL
+	}
+
+	if proxyProtocol != NoProxyProtocol {
+		// the upstream tls has to be wrapped by the proxy protocol socket
+		cluster.TransportSocket = proxyProtocol.ToEnvoy(cluster.TlsContext)
+		cluster.TlsContext = nil
+	}
+
+	return cluster
+}
+
+// UpstreamProxyProtocolSocket is missing in the go-control-plane version we use, so its config is built by hand
+const (
+	UpstreamProxyProtocolSocket = "envoy.transport_sockets.upstream_proxy_protocol"
+	RawBufferSocket             = "envoy.transport_sockets.raw_buffer"
+	TLSSocket                   = "envoy.transport_sockets.tls"
+	UpstreamTLSContextType      = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext"
+)
+
+func (P ProxyProtocolVersion) ToEnvoy(tlsContext *auth.UpstreamTlsContext) *core.TransportSocket {
+	version := "V1"
+	if P == ProxyProtocolV2 {
+		version = "V2"
+	}
+
+	innerSocket := map[string]*types.Value{
+		"name": StringValue(RawBufferSocket),
+	}
+	if tlsContext != nil {
+		tlsConfig, err := util.MessageToStruct(tlsContext)
+		if err != nil {
+			logrus.Warnf("Error generating upstream TLS for the PROXY protocol: %s", err.Error())
+		} else {
+			tlsConfig.Fields["@type"] = StringValue(UpstreamTLSContextType)
+			innerSocket = map[string]*types.Value{
+				"name":         StringValue(TLSSocket),
+				"typed_config": {Kind: &types.Value_StructValue{StructValue: tlsConfig}},
+			}
+		}
+	}
+
+	return &core.TransportSocket{
+		Name: UpstreamProxyProtocolSocket,
+		ConfigType: &core.TransportSocket_Config{
+			Config: &types.Struct{Fields: map[string]*types.Value{
+				"config": StructValue(map[string]*types.Value{
+					"version": StringValue(version),
+				}),
+				"transport_socket": StructValue(innerSocket),
+			}},
+		},
 	}
 }
 
 func (L *ListenerConfig) ToEnvoy(vhosts []*route.VirtualHost) (*v2.Listener, error) {
 	listenHost, listenPort := L.GenerateListenParts()
 
-	var FilterConfig *types.Struct
-
-	var FilterType string
+	var filterChains []*listener.FilterChain
 	var err error
 
-	logrus.Debugf("Generating listener for type: %s", string(L.Type))
+	logrus.Debugf("Generating listener for type: %d", L.Type)
 
 	switch L.Type {
 	case HTTP:
-		FilterType = util.HTTPConnectionManager
-		FilterConfig, err = util.MessageToStruct(L.GenerateHCM(vhosts))
+		filterChains, err = L.GenerateFilterChains(vhosts)
 	case TCP:
-		if len(vhosts) != 1 {
-			return nil, errors.New("there are too many or no vhosts to this listener")
+		if len(vhosts) == 0 {
+			return nil, errors.New("there are no vhosts to this listener")
 		}
-		FilterType = util.TCPProxy
-		FilterConfig, err = util.MessageToStruct(L.GenerateTCP(L.GenerateWeightedCluster(vhosts[0])))
+		filterChains, err = L.GenerateTCPFilterChains(vhosts)
+	case UDP:
+		return L.GenerateUDPListener()
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	var tlsContext *auth.DownstreamTlsContext = nil
-	if L.TLSSecret != nil {
-		if len(L.TLSSecret.Key) == 0 || len(L.TLSSecret.Certificate) == 0 {
-			logrus.Warnf("There is no TLS data for %s" + L.Name)
-		} else {
-			tlsContext = &auth.DownstreamTlsContext{
-				CommonTlsContext: &auth.CommonTlsContext{
-					TlsCertificates: []*auth.TlsCertificate{{
-						CertificateChain: &core.DataSource{
-							Specifier: &core.DataSource_InlineBytes{
-								InlineBytes: L.TLSSecret.Certificate,
-							},
-						},
-						PrivateKey: &core.DataSource{
-							Specifier: &core.DataSource_InlineBytes{
-								InlineBytes: L.TLSSecret.Key,
-							},
-						},
-					}},
-					/*ValidationContextType: &auth.CommonTlsContext_ValidationContext{
-						ValidationContext: &auth.CertificateValidationContext{
-							TrustedCa: &core.DataSource{
-								Specifier: &core.DataSource_InlineBytes{
-									InlineBytes: L.TLSSecret.CA,
-								},
-							},
-						},
-					},*/
-				},
-			}
-		}
-	}
-
-	return &v2.Listener{
+	envoyListener := &v2.Listener{
 		Name: L.Name,
 		Address: &core.Address{
 			Address: &core.Address_SocketAddress{
@@ -343,27 +918,319 @@ func (L *ListenerConfig) ToEnvoy(vhosts []*route.VirtualHost) (*v2.Listener, err
 				},
 			},
 		},
-		FilterChains: []*listener.FilterChain{{
-			Filters: []*listener.Filter{{
-				Name: FilterType,
-				ConfigType: &listener.Filter_Config{
-					Config: FilterConfig,
-				},
-			}},
-			TlsContext: tlsContext,
-		}},
-	}, nil
-}
+		FilterChains: filterChains,
+	}
 
-func (R *RouteConfig) ToEnvoy(routedClusters []*route.WeightedCluster_ClusterWeight) *route.Route {
-	totalWeight, _, _, _, _, _ := R.CalculateWeights()
+	// the PROXY protocol header comes before anything else the client sends
+	if L.AcceptsProxyProtocol() {
+		envoyListener.ListenerFilters = append(envoyListener.ListenerFilters, &listener.ListenerFilter{
+			Name: util.ProxyProtocol,
+		})
+	}
 
-	return &route.Route{
-		Match: &route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: R.PathPrefix,
-			},
+	// SNI can only be matched once the tls inspector had a look at the client hello
+	for i := range envoyListener.FilterChains {
+		if envoyListener.FilterChains[i].FilterChainMatch != nil {
+			envoyListener.ListenerFilters = append(envoyListener.ListenerFilters, &listener.ListenerFilter{
+				Name: util.TlsInspector,
+			})
+			break
+		}
+	}
+
+	return envoyListener, nil
+}
+
+// UDPProxyListenerFilter is missing in the go-control-plane version we use, so its config is built by hand
+const UDPProxyListenerFilter = "envoy.filters.udp_listener.udp_proxy"
+
+// GenerateUDPListener proxies the datagrams to the zone-aware cluster of the first route, UDP listeners have
+// no filter chains and support just a single listener filter
+func (L *ListenerConfig) GenerateUDPListener() (*v2.Listener, error) {
+	sortedVHosts := L.GetSortedVHosts()
+	if len(sortedVHosts) != 1 || len(sortedVHosts[0].Routes) == 0 {
+		return nil, errors.New("there are too many or no vhosts to this listener")
+	}
+	if len(sortedVHosts[0].Routes) > 1 {
+		logrus.Warnf("UDP listener %s can proxy to a single service only, using the first one", L.Name)
+	}
+
+	listenHost, listenPort := L.GenerateListenParts()
+	clusterName := GenerateClusterName(L.Name, sortedVHosts[0], sortedVHosts[0].GetSortedRoutes()[0])
+
+	return &v2.Listener{
+		Name: L.Name,
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol:   core.UDP,
+					Address:    listenHost,
+					Ipv4Compat: true,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: uint32(listenPort),
+					},
+				},
+			},
+		},
+		ListenerFilters: []*listener.ListenerFilter{{
+			Name: UDPProxyListenerFilter,
+			ConfigType: &listener.ListenerFilter_Config{
+				Config: &types.Struct{Fields: map[string]*types.Value{
+					"stat_prefix": StringValue(L.Name),
+					"cluster":     StringValue(clusterName),
+				}},
+			},
+		}},
+	}, nil
+}
+
+func XDSConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+			ApiConfigSource: &core.ApiConfigSource{
+				ApiType: core.ApiConfigSource_GRPC,
+				GrpcServices: []*core.GrpcService{{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+							ClusterName: "xds_cluster", // todo decide how this gets discovered
+						},
+					},
+				}},
+			},
+		},
+	}
+}
+
+// ToEnvoy only references the certificate, its content is distributed via SDS
+func (T *TlsData) ToEnvoy() *auth.DownstreamTlsContext {
+	return &auth.DownstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{
+				Name:      T.Name,
+				SdsConfig: XDSConfigSource(),
+			}},
+		},
+	}
+}
+
+func (T *TlsData) ToEnvoyCASecret() *auth.Secret {
+	return &auth.Secret{
+		Name: T.GenerateCASecretName(),
+		Type: &auth.Secret_ValidationContext{
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{
+						InlineBytes: T.CA,
+					},
+				},
+			},
+		},
+	}
+}
+
+// GenerateTLSContext returns nil when the vhost is not ready to serve TLS yet
+func (V *VirtualHost) GenerateTLSContext() *auth.DownstreamTlsContext {
+	if !V.TLSSecret.IsValid() {
+		logrus.Warnf("There is no TLS data for %s", V.Name)
+		return nil
+	}
+
+	tlsContext := V.TLSSecret.ToEnvoy()
+	if V.ClientCA == nil {
+		return tlsContext
+	}
+
+	if !V.ClientCA.HasCA() {
+		logrus.Warnf("There is no client CA for %s", V.Name)
+		return nil
+	}
+
+	// the CA is shared via SDS, the allowed SANs are specific to this vhost
+	tlsContext.RequireClientCertificate = &types.BoolValue{Value: true}
+	tlsContext.CommonTlsContext.ValidationContextType = &auth.CommonTlsContext_CombinedValidationContext{
+		CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
+			DefaultValidationContext: &auth.CertificateValidationContext{
+				VerifySubjectAltName: V.ClientAllowedSANs,
+			},
+			ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{
+				Name:      V.ClientCA.GenerateCASecretName(),
+				SdsConfig: XDSConfigSource(),
+			},
+		},
+	}
+
+	return tlsContext
+}
+
+func (T *TlsData) ToEnvoySecret() *auth.Secret {
+	return &auth.Secret{
+		Name: T.Name,
+		Type: &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{
+						InlineBytes: T.Certificate,
+					},
+				},
+				PrivateKey: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{
+						InlineBytes: T.Key,
+					},
+				},
+			},
+		},
+	}
+}
+
+// GenerateFilterChains gives every vhost with a certificate its own filter chain, matched by SNI on the vhost domains
+// and routing just that vhost. The other vhosts share the default chain without any match, secured by the catch-all
+// vhost certificate (or plaintext, if there is none). The default chain is left out when there is nothing for it to serve.
+// A vhost whose certificate or client CA is missing is never served without it, its chain refuses the connections.
+func (L *ListenerConfig) GenerateFilterChains(vhosts []*route.VirtualHost) ([]*listener.FilterChain, error) {
+	var filterChains []*listener.FilterChain
+	var defaultVHosts []*route.VirtualHost
+	var defaultTLSContext *auth.DownstreamTlsContext
+
+	for v := range vhosts {
+		vhost := L.FindVHost(vhosts[v].Name)
+		if vhost == nil || vhost.TLSSecret == nil {
+			defaultVHosts = append(defaultVHosts, vhosts[v])
+			continue
+		}
+
+		var serverNames []string
+		for d := range vhosts[v].Domains {
+			if vhosts[v].Domains[d] != "*" {
+				serverNames = append(serverNames, vhosts[v].Domains[d])
+			}
+		}
+
+		tlsContext := vhost.GenerateTLSContext()
+		if tlsContext == nil {
+			logrus.Warnf("Refusing connections to vhost %s on listener %s until its TLS data is ready", vhost.Name, L.Name)
+			if len(serverNames) != 0 {
+				filterChains = append(filterChains, RefusingFilterChain(serverNames))
+			}
+			continue
+		}
+
+		if len(serverNames) == 0 {
+			if defaultTLSContext == nil {
+				defaultTLSContext = tlsContext
+			}
+			defaultVHosts = append(defaultVHosts, vhosts[v])
+			continue
+		}
+
+		hcmFilter, err := L.GenerateHCMFilter(vhosts[v : v+1])
+		if err != nil {
+			return nil, err
+		}
+		filterChains = append(filterChains, &listener.FilterChain{
+			FilterChainMatch: &listener.FilterChainMatch{
+				ServerNames: serverNames,
+			},
+			Filters:    []*listener.Filter{hcmFilter},
+			TlsContext: tlsContext,
+		})
+	}
+
+	// a listener without any filter chain is refused by envoy, an empty default chain at least answers 404
+	if len(defaultVHosts) == 0 && len(filterChains) != 0 {
+		return filterChains, nil
+	}
+
+	hcmFilter, err := L.GenerateHCMFilter(defaultVHosts)
+	if err != nil {
+		return nil, err
+	}
+	return append(filterChains, &listener.FilterChain{
+		Filters:    []*listener.Filter{hcmFilter},
+		TlsContext: defaultTLSContext,
+	}), nil
+}
+
+// RefusingFilterChain matches the server names without any filters, so envoy closes their connections right away
+func RefusingFilterChain(serverNames []string) *listener.FilterChain {
+	return &listener.FilterChain{
+		FilterChainMatch: &listener.FilterChainMatch{
+			ServerNames: serverNames,
 		},
+	}
+}
+
+// GenerateTCPFilterChains gives every vhost its own tcp proxy, the vhosts with domains are told apart by SNI. Their TLS
+// is passed through to the service unless the vhost has a certificate of its own.
+func (L *ListenerConfig) GenerateTCPFilterChains(vhosts []*route.VirtualHost) ([]*listener.FilterChain, error) {
+	var filterChains []*listener.FilterChain
+	var defaultFilterChain *listener.FilterChain
+
+	for v := range vhosts {
+		tcpConfig, err := util.MessageToStruct(L.GenerateTCP(L.GenerateWeightedCluster(vhosts[v])))
+		if err != nil {
+			return nil, err
+		}
+
+		var filters []*listener.Filter
+		if rateLimit := L.GetListenerRateLimit(); rateLimit != nil {
+			filters = append(filters, rateLimit.ToEnvoyNetwork(L.Name))
+		}
+		filters = append(filters, &listener.Filter{
+			Name: util.TCPProxy,
+			ConfigType: &listener.Filter_Config{
+				Config: tcpConfig,
+			},
+		})
+
+		var serverNames []string
+		for d := range vhosts[v].Domains {
+			if vhosts[v].Domains[d] != "*" {
+				serverNames = append(serverNames, vhosts[v].Domains[d])
+			}
+		}
+
+		filterChain := &listener.FilterChain{Filters: filters}
+		if vhost := L.FindVHost(vhosts[v].Name); vhost != nil && vhost.TLSSecret != nil {
+			// passing the TLS through would skip the certificate checks the service asked for
+			if filterChain.TlsContext = vhost.GenerateTLSContext(); filterChain.TlsContext == nil {
+				logrus.Warnf("Refusing connections to vhost %s on listener %s until its TLS data is ready", vhost.Name, L.Name)
+				if len(serverNames) != 0 {
+					filterChains = append(filterChains, RefusingFilterChain(serverNames))
+				}
+				continue
+			}
+		}
+
+		if len(serverNames) == 0 {
+			if defaultFilterChain == nil {
+				defaultFilterChain = filterChain
+			}
+			continue
+		}
+
+		filterChain.FilterChainMatch = &listener.FilterChainMatch{
+			ServerNames: serverNames,
+		}
+		filterChains = append(filterChains, filterChain)
+	}
+
+	if defaultFilterChain != nil {
+		filterChains = append(filterChains, defaultFilterChain)
+	}
+
+	return filterChains, nil
+}
+
+func (R *RouteConfig) ToEnvoy(routedClusters []*route.WeightedCluster_ClusterWeight) *route.Route {
+	totalWeight, _, _, _, _, _ := R.CalculateWeights()
+
+	headers := R.Headers
+	if headers == nil {
+		headers = &HeadersConfig{}
+	}
+
+	envoyRoute := &route.Route{
+		Match: R.Match.ToEnvoy(R.PathPrefix),
 		Action: &route.Route_Route{
 			Route: &route.RouteAction{
 				ClusterSpecifier: &route.RouteAction_WeightedClusters{
@@ -372,9 +1239,528 @@ func (R *RouteConfig) ToEnvoy(routedClusters []*route.WeightedCluster_ClusterWei
 						TotalWeight: UInt32FromInteger(totalWeight),
 					},
 				},
-				PrefixRewrite: R.PrefixRewrite,
-				Timeout:       &R.Timeout,
+				PrefixRewrite:  R.PrefixRewrite,
+				Timeout:        &R.Timeout,
+				RetryPolicy:    R.RetryPolicy.ToEnvoy(),
+				HashPolicy:     R.GenerateHashPolicies(),
+				RateLimits:     R.GenerateRateLimits(),
+				Cors:           R.GenerateCors(),
+				UpgradeConfigs: R.GenerateUpgradeConfigs(),
+			},
+		},
+		PerFilterConfig:         R.GeneratePerFilterConfig(),
+		RequestHeadersToAdd:     HeaderValuesToEnvoy(headers.RequestHeadersToAdd),
+		RequestHeadersToRemove:  headers.RequestHeadersToRemove,
+		ResponseHeadersToAdd:    HeaderValuesToEnvoy(headers.ResponseHeadersToAdd),
+		ResponseHeadersToRemove: headers.ResponseHeadersToRemove,
+	}
+
+	if R.GRPC {
+		// streaming calls can't be limited by the route timeout, the client's grpc-timeout is capped by it instead
+		envoyRoute.GetRoute().MaxGrpcTimeout = &R.Timeout
+	}
+
+	if R.Redirect != nil {
+		envoyRoute.Action = &route.Route_Redirect{Redirect: R.Redirect.ToEnvoy()}
+	} else if R.DirectResponse != nil {
+		envoyRoute.Action = &route.Route_DirectResponse{DirectResponse: R.DirectResponse.ToEnvoy()}
+	}
+
+	return envoyRoute
+}
+
+func (R *RouteConfig) GenerateUpgradeConfigs() []*route.RouteAction_UpgradeConfig {
+	if !R.WebSocket {
+		return nil
+	}
+
+	return []*route.RouteAction_UpgradeConfig{{
+		UpgradeType: WebSocketUpgrade,
+		Enabled:     &types.BoolValue{Value: true},
+	}}
+}
+
+// GenerateCors returns the route's own CORS policy, the vhost-wide ones are set on the vhost
+func (R *RouteConfig) GenerateCors() *route.CorsPolicy {
+	if R.Cors == nil || R.Cors.PerVHost {
+		return nil
+	}
+	return R.Cors.ToEnvoy()
+}
+
+func (C *CorsConfig) ToEnvoy() *route.CorsPolicy {
+	if C == nil {
+		return nil
+	}
+
+	cors := &route.CorsPolicy{
+		AllowOrigin:      C.AllowOrigins,
+		AllowOriginRegex: C.AllowOriginRegex,
+		AllowMethods:     strings.Join(C.AllowMethods, ","),
+		AllowHeaders:     strings.Join(C.AllowHeaders, ","),
+		ExposeHeaders:    strings.Join(C.ExposeHeaders, ","),
+		AllowCredentials: &types.BoolValue{Value: C.AllowCredentials},
+	}
+
+	if C.MaxAge > 0 {
+		cors.MaxAge = strconv.Itoa(C.MaxAge)
+	}
+
+	return cors
+}
+
+func (R *RedirectConfig) ToEnvoy() *route.RedirectAction {
+	redirect := &route.RedirectAction{
+		HostRedirect: R.Host,
+		PortRedirect: uint32(R.Port),
+		StripQuery:   R.StripQuery,
+	}
+
+	if R.HTTPSRedirect {
+		redirect.SchemeRewriteSpecifier = &route.RedirectAction_HttpsRedirect{HttpsRedirect: true}
+	}
+
+	if R.Path != "" {
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: R.Path}
+	} else if R.PrefixRewrite != "" {
+		redirect.PathRewriteSpecifier = &route.RedirectAction_PrefixRewrite{PrefixRewrite: R.PrefixRewrite}
+	}
+
+	switch R.ResponseCode {
+	case 301, 0:
+		redirect.ResponseCode = route.RedirectAction_MOVED_PERMANENTLY
+	case 302:
+		redirect.ResponseCode = route.RedirectAction_FOUND
+	case 303:
+		redirect.ResponseCode = route.RedirectAction_SEE_OTHER
+	case 307:
+		redirect.ResponseCode = route.RedirectAction_TEMPORARY_REDIRECT
+	case 308:
+		redirect.ResponseCode = route.RedirectAction_PERMANENT_REDIRECT
+	default:
+		logrus.Warnf("Unsupported redirect code %d, using 301", R.ResponseCode)
+	}
+
+	return redirect
+}
+
+func (D *DirectResponseConfig) ToEnvoy() *route.DirectResponseAction {
+	directResponse := &route.DirectResponseAction{
+		Status: uint32(D.Status),
+	}
+
+	if D.Body != "" {
+		directResponse.Body = &core.DataSource{
+			Specifier: &core.DataSource_InlineString{InlineString: D.Body},
+		}
+	}
+
+	return directResponse
+}
+
+func (R *RouteConfig) GeneratePerFilterConfig() map[string]*types.Struct {
+	perFilterConfig := map[string]*types.Struct{}
+
+	if R.RateLimit != nil && !R.RateLimit.PerListener {
+		perFilterConfig[LocalRateLimitHTTPFilter] = R.RateLimit.ToEnvoyHTTP(R.Name)
+	}
+
+	if R.Fault != nil {
+		faultConfig, err := util.MessageToStruct(R.Fault.ToEnvoy())
+		if err != nil {
+			logrus.Warnf("Error generating fault injection for route %s: %s", R.Name, err.Error())
+		} else {
+			perFilterConfig[util.Fault] = faultConfig
+		}
+	}
+
+	if len(perFilterConfig) == 0 {
+		return nil
+	}
+	return perFilterConfig
+}
+
+func GenerateGlobalRateLimit() *ratelimitfilter.RateLimit {
+	return &ratelimitfilter.RateLimit{
+		Domain: RateLimitDomain,
+		RateLimitService: &ratelimit.RateLimitServiceConfig{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: RateLimitCluster,
+					},
+				},
 			},
 		},
 	}
 }
+
+func (A *RateLimitActionConfig) ToEnvoy() *route.RateLimit_Action {
+	switch {
+	case A.Header != "":
+		// envoy refuses an empty descriptor key, the header name is used instead
+		descriptorKey := A.DescriptorKey
+		if descriptorKey == "" {
+			descriptorKey = A.Header
+		}
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+			RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: A.Header, DescriptorKey: descriptorKey},
+		}}
+	case A.RemoteAddress:
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+			RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+		}}
+	case A.GenericKey != "":
+		return &route.RateLimit_Action{ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+			GenericKey: &route.RateLimit_Action_GenericKey{DescriptorValue: A.GenericKey},
+		}}
+	default:
+		return nil
+	}
+}
+
+func (R *RouteConfig) GenerateRateLimits() []*route.RateLimit {
+	var rateLimits []*route.RateLimit
+	for d := range R.RateLimitDescriptors {
+		rateLimit := &route.RateLimit{}
+		for a := range R.RateLimitDescriptors[d].Actions {
+			action := R.RateLimitDescriptors[d].Actions[a].ToEnvoy()
+			if action == nil {
+				logrus.Warnf("Skipping empty rate limit action on route %s", R.Name)
+				continue
+			}
+			rateLimit.Actions = append(rateLimit.Actions, action)
+		}
+		if len(rateLimit.Actions) > 0 {
+			rateLimits = append(rateLimits, rateLimit)
+		}
+	}
+	return rateLimits
+}
+
+// the local rate limit filters are newer than the vendored API, so their config is put together by hand
+const (
+	LocalRateLimitHTTPFilter    = "envoy.filters.http.local_ratelimit"
+	LocalRateLimitNetworkFilter = "envoy.filters.network.local_ratelimit"
+)
+
+func StructValue(fields map[string]*types.Value) *types.Value {
+	return &types.Value{Kind: &types.Value_StructValue{StructValue: &types.Struct{Fields: fields}}}
+}
+
+func StringValue(value string) *types.Value {
+	return &types.Value{Kind: &types.Value_StringValue{StringValue: value}}
+}
+
+func NumberValue(value int) *types.Value {
+	return &types.Value{Kind: &types.Value_NumberValue{NumberValue: float64(value)}}
+}
+
+func (L *LocalRateLimitConfig) GenerateTokenBucket() *types.Value {
+	maxTokens := L.Burst
+	if maxTokens < L.Requests {
+		maxTokens = L.Requests
+	}
+
+	return StructValue(map[string]*types.Value{
+		"max_tokens":      NumberValue(maxTokens),
+		"tokens_per_fill": NumberValue(L.Requests),
+		"fill_interval":   StringValue(fmt.Sprintf("%.3fs", L.Interval.Seconds())),
+	})
+}
+
+// ToEnvoyHTTP generates the http filter config, a nil limit only sets up the filter for the per route limits
+func (L *LocalRateLimitConfig) ToEnvoyHTTP(statPrefix string) *types.Struct {
+	config := &types.Struct{Fields: map[string]*types.Value{
+		"stat_prefix": StringValue(statPrefix),
+	}}
+
+	if L != nil {
+		config.Fields["token_bucket"] = L.GenerateTokenBucket()
+		// the filter is disabled by default
+		config.Fields["filter_enabled"] = StructValue(map[string]*types.Value{
+			"runtime_key":   StringValue("local_rate_limit_enabled"),
+			"default_value": StructValue(map[string]*types.Value{"numerator": NumberValue(100), "denominator": StringValue("HUNDRED")}),
+		})
+		config.Fields["filter_enforced"] = StructValue(map[string]*types.Value{
+			"runtime_key":   StringValue("local_rate_limit_enforced"),
+			"default_value": StructValue(map[string]*types.Value{"numerator": NumberValue(100), "denominator": StringValue("HUNDRED")}),
+		})
+	}
+
+	return config
+}
+
+// ToEnvoyNetwork generates the network filter limiting new connections of TCP listeners
+func (L *LocalRateLimitConfig) ToEnvoyNetwork(statPrefix string) *listener.Filter {
+	return &listener.Filter{
+		Name: LocalRateLimitNetworkFilter,
+		ConfigType: &listener.Filter_Config{
+			Config: &types.Struct{Fields: map[string]*types.Value{
+				"stat_prefix":  StringValue(statPrefix),
+				"token_bucket": L.GenerateTokenBucket(),
+			}},
+		},
+	}
+}
+
+func PercentToEnvoy(percent int) *_type.FractionalPercent {
+	if percent > 100 {
+		percent = 100
+	}
+
+	return &_type.FractionalPercent{
+		Numerator:   uint32(percent),
+		Denominator: _type.FractionalPercent_HUNDRED,
+	}
+}
+
+func (F *FaultInjectionConfig) ToEnvoy() *faultfilter.HTTPFault {
+	httpFault := &faultfilter.HTTPFault{}
+
+	if F.Delay > 0 {
+		httpFault.Delay = &fault.FaultDelay{
+			FaultDelaySecifier: &fault.FaultDelay_FixedDelay{FixedDelay: &F.Delay},
+			Percentage:         PercentToEnvoy(F.DelayPercent),
+		}
+	}
+
+	if F.AbortStatus > 0 {
+		httpFault.Abort = &faultfilter.FaultAbort{
+			ErrorType:  &faultfilter.FaultAbort_HttpStatus{HttpStatus: uint32(F.AbortStatus)},
+			Percentage: PercentToEnvoy(F.AbortPercent),
+		}
+	}
+
+	for i := range F.Headers {
+		httpFault.Headers = append(httpFault.Headers, F.Headers[i].ToEnvoy())
+	}
+
+	return httpFault
+}
+
+func (H *HeaderMatchConfig) ToEnvoy() *route.HeaderMatcher {
+	matcher := &route.HeaderMatcher{
+		Name:        H.Name,
+		InvertMatch: H.Invert,
+	}
+
+	switch H.Type {
+	case HeaderExactMatch:
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: H.Value}
+	case HeaderRegexMatch:
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{RegexMatch: H.Value}
+	case HeaderPrefixMatch:
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{PrefixMatch: H.Value}
+	case HeaderSuffixMatch:
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_SuffixMatch{SuffixMatch: H.Value}
+	case HeaderPresentMatch:
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+	}
+
+	return matcher
+}
+
+func (Q *QueryParameterMatchConfig) ToEnvoy() *route.QueryParameterMatcher {
+	return &route.QueryParameterMatcher{
+		Name:  Q.Name,
+		Value: Q.Value,
+		Regex: &types.BoolValue{
+			Value: Q.Regex,
+		},
+	}
+}
+
+func (M *MatchConfig) ToEnvoy(pathPrefix string) *route.RouteMatch {
+	routeMatch := &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{
+			Prefix: pathPrefix,
+		},
+	}
+
+	if M == nil {
+		return routeMatch
+	}
+
+	if M.Path != "" {
+		routeMatch.PathSpecifier = &route.RouteMatch_Path{
+			Path: M.Path,
+		}
+	} else if M.Regex != "" {
+		routeMatch.PathSpecifier = &route.RouteMatch_Regex{
+			Regex: M.Regex,
+		}
+	}
+
+	for i := range M.Headers {
+		routeMatch.Headers = append(routeMatch.Headers, M.Headers[i].ToEnvoy())
+	}
+
+	for i := range M.QueryParameters {
+		routeMatch.QueryParameters = append(routeMatch.QueryParameters, M.QueryParameters[i].ToEnvoy())
+	}
+
+	return routeMatch
+}
+
+func (R *RetryPolicyConfig) ToEnvoy() *route.RetryPolicy {
+	if R == nil {
+		return nil
+	}
+
+	retryPolicy := &route.RetryPolicy{
+		RetryOn:                       R.RetryOn,
+		NumRetries:                    OptionalUInt32FromInteger(R.NumRetries), // envoy retries once by default
+		HostSelectionRetryMaxAttempts: int64(R.HostSelectionMaxAttempts),
+	}
+
+	if R.PerTryTimeout > 0 {
+		retryPolicy.PerTryTimeout = &R.PerTryTimeout
+	}
+
+	for i := range R.RetriableStatusCodes {
+		retryPolicy.RetriableStatusCodes = append(retryPolicy.RetriableStatusCodes, uint32(R.RetriableStatusCodes[i]))
+	}
+
+	if R.AvoidPreviousHosts {
+		retryPolicy.RetryHostPredicate = []*route.RetryPolicy_RetryHostPredicate{{
+			Name: "envoy.retry_host_predicates.previous_hosts",
+		}}
+	}
+
+	if R.BackOffBaseInterval > 0 {
+		retryPolicy.RetryBackOff = &route.RetryPolicy_RetryBackOff{
+			BaseInterval: &R.BackOffBaseInterval,
+		}
+		if R.BackOffMaxInterval > 0 {
+			retryPolicy.RetryBackOff.MaxInterval = &R.BackOffMaxInterval
+		}
+	}
+
+	return retryPolicy
+}
+
+// TCPGRPCAccessLog is missing in the util package
+const TCPGRPCAccessLog = "envoy.tcp_grpc_access_log"
+
+func (A *AccessLogConfig) ToEnvoy(logName string, proxyType ProxyType) []*accesslog.AccessLog {
+	var accessLogs []*accesslog.AccessLog
+	filter := A.GenerateFilter(logName, proxyType)
+
+	if A.Path != "" {
+		fileConfig, err := util.MessageToStruct(A.GenerateFileAccessLog())
+		if err != nil {
+			logrus.Warnf("Error generating access log for %s: %s", logName, err.Error())
+		} else {
+			accessLogs = append(accessLogs, &accesslog.AccessLog{
+				Name:       util.FileAccessLog,
+				Filter:     filter,
+				ConfigType: &accesslog.AccessLog_Config{Config: fileConfig},
+			})
+		}
+	}
+
+	if A.Cluster != "" {
+		commonConfig := &accesslogconfig.CommonGrpcAccessLogConfig{
+			LogName: logName,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: A.Cluster,
+					},
+				},
+			},
+		}
+
+		name := util.HTTPGRPCAccessLog
+		var grpcConfig *types.Struct
+		var err error
+		if proxyType == TCP {
+			name = TCPGRPCAccessLog
+			grpcConfig, err = util.MessageToStruct(&accesslogconfig.TcpGrpcAccessLogConfig{CommonConfig: commonConfig})
+		} else {
+			grpcConfig, err = util.MessageToStruct(&accesslogconfig.HttpGrpcAccessLogConfig{CommonConfig: commonConfig})
+		}
+
+		if err != nil {
+			logrus.Warnf("Error generating gRPC access log for %s: %s", logName, err.Error())
+		} else {
+			accessLogs = append(accessLogs, &accesslog.AccessLog{
+				Name:       name,
+				Filter:     filter,
+				ConfigType: &accesslog.AccessLog_Config{Config: grpcConfig},
+			})
+		}
+	}
+
+	return accessLogs
+}
+
+func (A *AccessLogConfig) GenerateFileAccessLog() *accesslogconfig.FileAccessLog {
+	fileAccessLog := &accesslogconfig.FileAccessLog{Path: A.Path}
+	if A.Format == "" {
+		return fileAccessLog // envoy's default format
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(A.Format), "{") {
+		var jsonFormat map[string]string
+		if err := json.Unmarshal([]byte(A.Format), &jsonFormat); err != nil {
+			logrus.Warnf("Invalid JSON access log format, using it as text: %s", err.Error())
+		} else {
+			fields := map[string]*types.Value{}
+			for key := range jsonFormat {
+				fields[key] = StringValue(jsonFormat[key])
+			}
+			fileAccessLog.AccessLogFormat = &accesslogconfig.FileAccessLog_JsonFormat{JsonFormat: &types.Struct{Fields: fields}}
+			return fileAccessLog
+		}
+	}
+
+	fileAccessLog.AccessLogFormat = &accesslogconfig.FileAccessLog_Format{Format: A.Format}
+	return fileAccessLog
+}
+
+// GenerateFilter limits the logged requests by their status code and sampling, status codes are HTTP only
+func (A *AccessLogConfig) GenerateFilter(logName string, proxyType ProxyType) *accesslog.AccessLogFilter {
+	var filters []*accesslog.AccessLogFilter
+
+	if A.MinStatus > 0 && proxyType == HTTP {
+		filters = append(filters, &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_StatusCodeFilter{
+				StatusCodeFilter: &accesslog.StatusCodeFilter{
+					Comparison: &accesslog.ComparisonFilter{
+						Op: accesslog.ComparisonFilter_GE,
+						Value: &core.RuntimeUInt32{
+							DefaultValue: uint32(A.MinStatus),
+							RuntimeKey:   "access_log." + logName + ".min_status",
+						},
+					},
+				},
+			},
+		})
+	}
+
+	if A.SamplePercent > 0 && A.SamplePercent < 100 {
+		filters = append(filters, &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_RuntimeFilter{
+				RuntimeFilter: &accesslog.RuntimeFilter{
+					RuntimeKey:     "access_log." + logName + ".sample",
+					PercentSampled: PercentToEnvoy(A.SamplePercent),
+				},
+			},
+		})
+	}
+
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	default:
+		return &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_AndFilter{
+				AndFilter: &accesslog.AndFilter{Filters: filters},
+			},
+		}
+	}
+}
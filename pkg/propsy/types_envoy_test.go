@@ -1,14 +1,31 @@
 package propsy
 
 import (
+	"bytes"
 	v22 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	listener2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	fault "github.com/envoyproxy/go-control-plane/envoy/config/filter/fault/v2"
+	extauthz "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
+	faultfilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/fault/v2"
+	gzip "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/gzip/v2"
+	jwtauthn "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	ratelimitfilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rate_limit/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v2"
+	_type "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/envoyproxy/go-control-plane/pkg/util"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/seznam/ProPsy/pkg/testutils"
 	"log"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHCM(T *testing.T) {
@@ -43,7 +60,7 @@ func TestHCM(T *testing.T) {
 	listenerEnvoy, _ := listener.ToEnvoy(nil)
 	_listenerEnvoy := &v22.Listener{
 		Name: "foobar",
-		Address: core.Address{
+		Address: &core.Address{
 			Address: &core.Address_SocketAddress{
 				SocketAddress: &core.SocketAddress{
 					Address:    "0.0.0.0",
@@ -54,8 +71,8 @@ func TestHCM(T *testing.T) {
 				},
 			},
 		},
-		FilterChains: []listener2.FilterChain{{
-			Filters: []listener2.Filter{{
+		FilterChains: []*listener2.FilterChain{{
+			Filters: []*listener2.Filter{{
 				Name: util.HTTPConnectionManager,
 				ConfigType: &listener2.Filter_Config{
 					Config: _hcmStruct,
@@ -68,3 +85,1139 @@ func TestHCM(T *testing.T) {
 		log.Fatalf("Listener does not match: %+v vs %+v", listenerEnvoy, _listenerEnvoy)
 	}
 }
+
+func TestRouteMatch(T *testing.T) {
+	var match *MatchConfig
+	_match := &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{
+			Prefix: "/foo/",
+		},
+	}
+
+	if !proto.Equal(match.ToEnvoy("/foo/"), _match) {
+		log.Fatalf("RouteMatch does not match: %+v vs %+v", match.ToEnvoy("/foo/"), _match)
+	}
+
+	match = &MatchConfig{
+		Regex: "/foo/[0-9]+",
+		Headers: []*HeaderMatchConfig{
+			{Name: "x-canary", Value: "1", Type: HeaderExactMatch},
+			{Name: "x-debug", Type: HeaderPresentMatch, Invert: true},
+		},
+		QueryParameters: []*QueryParameterMatchConfig{
+			{Name: "version", Value: "v[12]", Regex: true},
+		},
+	}
+	_match = &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Regex{
+			Regex: "/foo/[0-9]+",
+		},
+		Headers: []*route.HeaderMatcher{
+			{
+				Name:                 "x-canary",
+				HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: "1"},
+			},
+			{
+				Name:                 "x-debug",
+				HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+				InvertMatch:          true,
+			},
+		},
+		QueryParameters: []*route.QueryParameterMatcher{
+			{
+				Name:  "version",
+				Value: "v[12]",
+				Regex: &types.BoolValue{Value: true},
+			},
+		},
+	}
+
+	if !proto.Equal(match.ToEnvoy("/foo/"), _match) {
+		log.Fatalf("RouteMatch does not match: %+v vs %+v", match.ToEnvoy("/foo/"), _match)
+	}
+
+	match = &MatchConfig{Path: "/foo/exact"}
+	_match = &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Path{
+			Path: "/foo/exact",
+		},
+	}
+
+	if !proto.Equal(match.ToEnvoy("/foo/"), _match) {
+		log.Fatalf("RouteMatch does not match: %+v vs %+v", match.ToEnvoy("/foo/"), _match)
+	}
+}
+
+// chainVHosts lists the vhosts routed by the connection manager of the filter chain
+func chainVHosts(filterChain *listener2.FilterChain) []string {
+	connectionManager := &v2.HttpConnectionManager{}
+	if err := util.StructToMessage(filterChain.Filters[0].GetConfig(), connectionManager); err != nil {
+		log.Fatalf("Error reading the connection manager: %s", err.Error())
+	}
+
+	var names []string
+	for _, vhost := range connectionManager.GetRouteConfig().VirtualHosts {
+		names = append(names, vhost.Name)
+	}
+	return names
+}
+
+func TestListenerSNI(T *testing.T) {
+	listener := ListenerConfig{Listen: "443", Name: "foobar", VirtualHosts: []*VirtualHost{
+		{Name: "*", Domains: []string{"*"}},
+		{Name: "www.example.cz", Domains: []string{"www.example.cz"}, TLSSecret: &TlsData{Name: "ns__www", Certificate: []byte("www-crt"), Key: []byte("www-key")}},
+		{Name: "api.example.cz", Domains: []string{"api.example.cz"}, TLSSecret: &TlsData{Name: "ns__api", Certificate: []byte("api-crt"), Key: []byte("api-key")}},
+		{Name: "plain.example.cz", Domains: []string{"plain.example.cz"}},
+	}}
+	vhosts := []*route.VirtualHost{
+		{Name: "api.example.cz", Domains: []string{"api.example.cz"}},
+		{Name: "plain.example.cz", Domains: []string{"plain.example.cz"}},
+		{Name: "www.example.cz", Domains: []string{"www.example.cz"}},
+		{Name: "*", Domains: []string{"*"}},
+	}
+
+	listenerEnvoy, err := listener.ToEnvoy(vhosts)
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+
+	// every chain routes only the vhosts it is secured for
+	testutils.AssertInt(len(listenerEnvoy.FilterChains), 3)
+	testutils.AssertString(listenerEnvoy.FilterChains[0].FilterChainMatch.ServerNames[0], "api.example.cz")
+	testutils.AssertString(listenerEnvoy.FilterChains[0].TlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0].Name, "ns__api")
+	testutils.AssertString(strings.Join(chainVHosts(listenerEnvoy.FilterChains[0]), ","), "api.example.cz")
+	testutils.AssertString(listenerEnvoy.FilterChains[1].FilterChainMatch.ServerNames[0], "www.example.cz")
+	testutils.AssertString(listenerEnvoy.FilterChains[1].TlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0].Name, "ns__www")
+	testutils.AssertString(strings.Join(chainVHosts(listenerEnvoy.FilterChains[1]), ","), "www.example.cz")
+	if listenerEnvoy.FilterChains[2].FilterChainMatch != nil || listenerEnvoy.FilterChains[2].TlsContext != nil {
+		log.Fatalf("Default filter chain should be plaintext without any match: %+v", listenerEnvoy.FilterChains[2])
+	}
+	testutils.AssertString(strings.Join(chainVHosts(listenerEnvoy.FilterChains[2]), ","), "plain.example.cz,*")
+	testutils.AssertInt(len(listenerEnvoy.ListenerFilters), 1)
+	testutils.AssertString(listenerEnvoy.ListenerFilters[0].Name, util.TlsInspector)
+
+	listener.FindVHost("*").TLSSecret = &TlsData{Name: "ns__default", Certificate: []byte("default-crt"), Key: []byte("default-key")}
+	listenerEnvoy, _ = listener.ToEnvoy(vhosts)
+	testutils.AssertString(listenerEnvoy.FilterChains[2].TlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs[0].Name, "ns__default")
+
+	// without a catch-all vhost nothing is left for the default chain
+	listener.VirtualHosts = listener.VirtualHosts[1:3]
+	listenerEnvoy, _ = listener.ToEnvoy([]*route.VirtualHost{vhosts[0], vhosts[2]})
+	testutils.AssertInt(len(listenerEnvoy.FilterChains), 2)
+	for i := range listenerEnvoy.FilterChains {
+		if listenerEnvoy.FilterChains[i].FilterChainMatch == nil {
+			log.Fatalf("There should be no default filter chain: %+v", listenerEnvoy.FilterChains[i])
+		}
+	}
+}
+
+func TestListenerMissingClientCA(T *testing.T) {
+	listener := ListenerConfig{Listen: "443", Name: "foobar", VirtualHosts: []*VirtualHost{
+		{Name: "*", Domains: []string{"*"}, TLSSecret: &TlsData{Name: "ns__default", Certificate: []byte("default-crt"), Key: []byte("default-key")},
+			ClientCA: &TlsData{Name: "ns__default-ca"}},
+		{Name: "internal.example.cz", Domains: []string{"internal.example.cz"}, TLSSecret: &TlsData{Name: "ns__internal", Certificate: []byte("crt"), Key: []byte("key")},
+			ClientCA: &TlsData{Name: "ns__client-ca"}},
+		{Name: "plain.example.cz", Domains: []string{"plain.example.cz"}},
+	}}
+	vhosts := []*route.VirtualHost{
+		{Name: "internal.example.cz", Domains: []string{"internal.example.cz"}},
+		{Name: "plain.example.cz", Domains: []string{"plain.example.cz"}},
+		{Name: "*", Domains: []string{"*"}},
+	}
+
+	listenerEnvoy, err := listener.ToEnvoy(vhosts)
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+
+	// the mTLS vhost keeps its chain, which closes the connections instead of serving them without the client check
+	testutils.AssertInt(len(listenerEnvoy.FilterChains), 2)
+	testutils.AssertString(listenerEnvoy.FilterChains[0].FilterChainMatch.ServerNames[0], "internal.example.cz")
+	if listenerEnvoy.FilterChains[0].Filters != nil || listenerEnvoy.FilterChains[0].TlsContext != nil {
+		log.Fatalf("Filter chain without the client CA should refuse connections: %+v", listenerEnvoy.FilterChains[0])
+	}
+
+	// neither the mTLS vhost nor the catch-all one waiting for its CA are served by the default chain
+	if listenerEnvoy.FilterChains[1].FilterChainMatch != nil || listenerEnvoy.FilterChains[1].TlsContext != nil {
+		log.Fatalf("Default filter chain should be plaintext without any match: %+v", listenerEnvoy.FilterChains[1])
+	}
+	testutils.AssertString(strings.Join(chainVHosts(listenerEnvoy.FilterChains[1]), ","), "plain.example.cz")
+
+	// the same goes for TLS terminated by TCP services
+	listener.Type = TCP
+	listenerEnvoy, err = listener.ToEnvoy(vhosts)
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+	testutils.AssertInt(len(listenerEnvoy.FilterChains), 2)
+	testutils.AssertString(listenerEnvoy.FilterChains[0].FilterChainMatch.ServerNames[0], "internal.example.cz")
+	if listenerEnvoy.FilterChains[0].Filters != nil {
+		log.Fatalf("Filter chain without the client CA should refuse connections: %+v", listenerEnvoy.FilterChains[0])
+	}
+	testutils.AssertString(listenerEnvoy.FilterChains[1].FilterChainMatch.ServerNames[0], "plain.example.cz")
+
+	listener.FindVHost("internal.example.cz").ClientCA.CA = []byte("ca")
+	listenerEnvoy, _ = listener.ToEnvoy(vhosts)
+	testutils.AssertString(listenerEnvoy.FilterChains[0].Filters[0].Name, util.TCPProxy)
+	if !listenerEnvoy.FilterChains[0].TlsContext.RequireClientCertificate.Value {
+		log.Fatalf("Filter chain should require the client certificate: %+v", listenerEnvoy.FilterChains[0])
+	}
+}
+
+func TestSecrets(T *testing.T) {
+	tlsData := &TlsData{Name: "ns__www", Certificate: []byte("www-crt"), Key: []byte("www-key")}
+	node := NodeConfig{Listeners: []*ListenerConfig{
+		{Name: "foo", VirtualHosts: []*VirtualHost{{Name: "www", TLSSecret: tlsData}, {Name: "*", TLSSecret: &TlsData{Name: "ns__empty"}}}},
+		{Name: "bar", VirtualHosts: []*VirtualHost{{Name: "www", TLSSecret: tlsData}}},
+	}}
+
+	secrets := GenerateSecrets(&node)
+	testutils.AssertInt(len(secrets), 1)
+
+	_secret := &auth.Secret{
+		Name: "ns__www",
+		Type: &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{
+						InlineBytes: []byte("www-crt"),
+					},
+				},
+				PrivateKey: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{
+						InlineBytes: []byte("www-key"),
+					},
+				},
+			},
+		},
+	}
+
+	if !proto.Equal(secrets[0], _secret) {
+		log.Fatalf("Secret does not match: %+v vs %+v", secrets[0], _secret)
+	}
+}
+
+func TestClientCertificateValidation(T *testing.T) {
+	vhost := VirtualHost{
+		Name:              "internal.example.cz",
+		Domains:           []string{"internal.example.cz"},
+		TLSSecret:         &TlsData{Name: "ns__internal", Certificate: []byte("crt"), Key: []byte("key")},
+		ClientCA:          &TlsData{Name: "ns__client-ca"},
+		ClientAllowedSANs: []string{"client.example.cz"},
+	}
+
+	if vhost.GenerateTLSContext() != nil {
+		log.Fatalf("TLS context should not be generated while the client CA is missing")
+	}
+
+	vhost.ClientCA.CA = []byte("ca")
+	_tlsContext := &auth.DownstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{
+				Name:      "ns__internal",
+				SdsConfig: XDSConfigSource(),
+			}},
+			ValidationContextType: &auth.CommonTlsContext_CombinedValidationContext{
+				CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
+					DefaultValidationContext: &auth.CertificateValidationContext{
+						VerifySubjectAltName: []string{"client.example.cz"},
+					},
+					ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{
+						Name:      "ns__client-ca__ca",
+						SdsConfig: XDSConfigSource(),
+					},
+				},
+			},
+		},
+		RequireClientCertificate: &types.BoolValue{Value: true},
+	}
+
+	if !proto.Equal(vhost.GenerateTLSContext(), _tlsContext) {
+		log.Fatalf("TLS context does not match: %+v vs %+v", vhost.GenerateTLSContext(), _tlsContext)
+	}
+
+	secrets := GenerateSecrets(&NodeConfig{Listeners: []*ListenerConfig{{VirtualHosts: []*VirtualHost{&vhost}}}})
+	testutils.AssertInt(len(secrets), 2)
+	testutils.AssertString(string(secrets[1].(*auth.Secret).GetValidationContext().TrustedCa.GetInlineBytes()), "ca")
+}
+
+func TestRetryBudget(T *testing.T) {
+	thresholds := &CircuitBreakerThresholds{MaxRequests: 100}
+	if thresholds.ToEnvoy(core.RoutingPriority_DEFAULT).XXX_unrecognized != nil {
+		log.Fatalf("Retry budget should not be generated when not set")
+	}
+
+	// retry_budget (8) holding budget_percent (1) of 20.0 and min_retry_concurrency (2) of 5
+	_retryBudget := []byte{
+		0x42, 0x0f,
+		0x0a, 0x09, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x34, 0x40,
+		0x12, 0x02, 0x08, 0x05,
+	}
+	thresholds.RetryBudgetPercent, thresholds.MinRetryConcurrency = 20, 5
+	envoyThresholds := thresholds.ToEnvoy(core.RoutingPriority_DEFAULT)
+	if !bytes.Equal(envoyThresholds.XXX_unrecognized, _retryBudget) {
+		log.Fatalf("Retry budget does not match: %x vs %x", envoyThresholds.XXX_unrecognized, _retryBudget)
+	}
+
+	// the budget survives the cluster being sent to envoy
+	envoyCluster := ClusterToEnvoy("foobar", 100, 0, nil, nil, nil, &CircuitBreakersConfig{Default: thresholds}, RoundRobinLB, HTTP1Upstream, NoProxyProtocol)
+	serialized, err := proto.Marshal(envoyCluster)
+	if err != nil {
+		log.Fatalf("Error serializing cluster: %s", err.Error())
+	}
+	if !bytes.Contains(serialized, _retryBudget) {
+		log.Fatalf("Retry budget is missing in the serialized cluster: %x", serialized)
+	}
+
+	// envoy keeps its default minimal concurrency unless set
+	thresholds.MinRetryConcurrency = 0
+	testutils.AssertInt(len(thresholds.ToEnvoy(core.RoutingPriority_DEFAULT).XXX_unrecognized), 13)
+}
+
+func TestRetryPolicy(T *testing.T) {
+	var noRetries *RetryPolicyConfig
+	if noRetries.ToEnvoy() != nil {
+		log.Fatalf("Retry policy should not be generated when not set")
+	}
+
+	retryPolicy := &RetryPolicyConfig{
+		RetryOn:                  "5xx,retriable-status-codes",
+		NumRetries:               3,
+		PerTryTimeout:            250 * time.Millisecond,
+		RetriableStatusCodes:     []int{409, 429},
+		AvoidPreviousHosts:       true,
+		HostSelectionMaxAttempts: 5,
+		BackOffBaseInterval:      25 * time.Millisecond,
+		BackOffMaxInterval:       100 * time.Millisecond,
+	}
+
+	perTryTimeout := 250 * time.Millisecond
+	baseInterval := 25 * time.Millisecond
+	maxInterval := 100 * time.Millisecond
+	_retryPolicy := &route.RetryPolicy{
+		RetryOn:              "5xx,retriable-status-codes",
+		NumRetries:           &types.UInt32Value{Value: 3},
+		PerTryTimeout:        &perTryTimeout,
+		RetriableStatusCodes: []uint32{409, 429},
+		RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{{
+			Name: "envoy.retry_host_predicates.previous_hosts",
+		}},
+		HostSelectionRetryMaxAttempts: 5,
+		RetryBackOff: &route.RetryPolicy_RetryBackOff{
+			BaseInterval: &baseInterval,
+			MaxInterval:  &maxInterval,
+		},
+	}
+
+	if !proto.Equal(retryPolicy.ToEnvoy(), _retryPolicy) {
+		log.Fatalf("Retry policy does not match: %+v vs %+v", retryPolicy.ToEnvoy(), _retryPolicy)
+	}
+
+	// without numRetries envoy's default applies instead of disabling the retries
+	onlyRetryOn := &RetryPolicyConfig{RetryOn: "5xx,reset,connect-failure"}
+	if !proto.Equal(onlyRetryOn.ToEnvoy(), &route.RetryPolicy{RetryOn: "5xx,reset,connect-failure"}) {
+		log.Fatalf("Retry policy without retries set does not match: %+v", onlyRetryOn.ToEnvoy())
+	}
+
+	routeConfig := RouteConfig{
+		Name:        "retried",
+		PathPrefix:  "/",
+		RetryPolicy: retryPolicy,
+		Clusters:    []*ClusterConfig{{Name: "foo", Weight: 100, EndpointConfig: &EndpointConfig{Locality: &Locality{Zone: LocalZone}}}},
+	}
+	if !proto.Equal(routeConfig.ToEnvoy(nil).GetRoute().RetryPolicy, _retryPolicy) {
+		log.Fatalf("Retry policy is not set on the route")
+	}
+}
+
+func TestMirror(T *testing.T) {
+	LocalZone = "test"
+	primary := &ClusterConfig{Name: "0-ns-primary", Weight: 100, EndpointConfig: &EndpointConfig{
+		Endpoints: []*Endpoint{{Host: "1.1.1.1", Healthy: true}},
+		Locality:  &Locality{Zone: "test"},
+	}}
+	mirror := &ClusterConfig{Name: "0-ns-mirror", Weight: 10, IsMirror: true, EndpointConfig: &EndpointConfig{
+		Endpoints: []*Endpoint{{Host: "2.2.2.2", Healthy: true}},
+		Locality:  &Locality{Zone: "test"},
+	}}
+	foreignMirror := &ClusterConfig{Name: "1-ns-mirror", Weight: 50, Priority: 1, IsMirror: true, EndpointConfig: &EndpointConfig{
+		Endpoints: []*Endpoint{{Host: "3.3.3.3", Healthy: true}},
+		Locality:  &Locality{Zone: "other"},
+	}}
+
+	routeConfig := RouteConfig{Name: "mirrored", Clusters: []*ClusterConfig{mirror, primary, foreignMirror}}
+	if routeConfig.GetLocalBestCluster(false) != primary || routeConfig.GetLocalBestMirror() != mirror {
+		log.Fatalf("Mirrors should not be picked as the primary cluster")
+	}
+
+	totalWeight, localZoneWeight, _, _, _, _ := routeConfig.CalculateWeights()
+	testutils.AssertInt(totalWeight, 100)
+	testutils.AssertInt(localZoneWeight, 100)
+
+	testutils.AssertInt(len(routeConfig.GeneratePrioritizedEndpoints(LocalZone)), 1)
+	mirrorEndpoints := routeConfig.GenerateMirrorEndpoints()
+	testutils.AssertInt(len(mirrorEndpoints), 2)
+	testutils.AssertInt(int(mirrorEndpoints[0].Priority), 0)
+	testutils.AssertInt(int(mirrorEndpoints[1].Priority), 1)
+
+	_mirrorPolicy := &route.RouteAction_RequestMirrorPolicy{
+		Cluster: "mirrored-mirror",
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &_type.FractionalPercent{Numerator: 10, Denominator: _type.FractionalPercent_HUNDRED},
+		},
+	}
+	if !proto.Equal(routeConfig.GenerateMirrorPolicy("mirrored-mirror"), _mirrorPolicy) {
+		log.Fatalf("Mirror policy does not match: %+v vs %+v", routeConfig.GenerateMirrorPolicy("mirrored-mirror"), _mirrorPolicy)
+	}
+
+	mirror.Weight = 0
+	if routeConfig.GenerateMirrorPolicy("mirrored-mirror") != nil {
+		log.Fatalf("Nothing should be mirrored with zero percent")
+	}
+}
+
+func TestFaultInjection(T *testing.T) {
+	faultConfig := &FaultInjectionConfig{
+		DelayPercent: 10,
+		Delay:        2 * time.Second,
+		AbortPercent: 5,
+		AbortStatus:  503,
+		Headers:      []*HeaderMatchConfig{{Name: "x-chaos", Type: HeaderPresentMatch}},
+	}
+	routeConfig := &RouteConfig{Name: "chaos", Fault: faultConfig}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{{Name: "calm"}}}}}
+
+	testutils.AssertInt(len(listener.GenerateHTTPFilters()), 1)
+
+	listener.VirtualHosts[0].Routes = append(listener.VirtualHosts[0].Routes, routeConfig)
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, util.Fault)
+	testutils.AssertString(filters[1].Name, util.Router)
+
+	delay := 2 * time.Second
+	_fault := &faultfilter.HTTPFault{
+		Delay: &fault.FaultDelay{
+			FaultDelaySecifier: &fault.FaultDelay_FixedDelay{FixedDelay: &delay},
+			Percentage:         &_type.FractionalPercent{Numerator: 10, Denominator: _type.FractionalPercent_HUNDRED},
+		},
+		Abort: &faultfilter.FaultAbort{
+			ErrorType:  &faultfilter.FaultAbort_HttpStatus{HttpStatus: 503},
+			Percentage: &_type.FractionalPercent{Numerator: 5, Denominator: _type.FractionalPercent_HUNDRED},
+		},
+		Headers: []*route.HeaderMatcher{{
+			Name:                 "x-chaos",
+			HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+		}},
+	}
+
+	if !proto.Equal(faultConfig.ToEnvoy(), _fault) {
+		log.Fatalf("Fault injection does not match: %+v vs %+v", faultConfig.ToEnvoy(), _fault)
+	}
+
+	_faultStruct, _ := util.MessageToStruct(_fault)
+	if !proto.Equal(routeConfig.GeneratePerFilterConfig()[util.Fault], _faultStruct) {
+		log.Fatalf("Fault injection is not set on the route")
+	}
+	if listener.VirtualHosts[0].Routes[0].GeneratePerFilterConfig() != nil {
+		log.Fatalf("Routes without faults should not have any per filter config")
+	}
+}
+
+func TestLocalRateLimit(T *testing.T) {
+	routeLimit := &LocalRateLimitConfig{Requests: 100, Interval: time.Second, Burst: 150}
+	routeConfig := &RouteConfig{Name: "limited", RateLimit: routeLimit}
+	listener := ListenerConfig{Name: "foobar", Type: HTTP, VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{routeConfig}}}}
+
+	_tokenBucket := &types.Struct{Fields: map[string]*types.Value{
+		"max_tokens":      {Kind: &types.Value_NumberValue{NumberValue: 150}},
+		"tokens_per_fill": {Kind: &types.Value_NumberValue{NumberValue: 100}},
+		"fill_interval":   {Kind: &types.Value_StringValue{StringValue: "1.000s"}},
+	}}
+	if !proto.Equal(routeLimit.GenerateTokenBucket().GetStructValue(), _tokenBucket) {
+		log.Fatalf("Token bucket does not match: %+v vs %+v", routeLimit.GenerateTokenBucket(), _tokenBucket)
+	}
+
+	// per route limits only need the filter to be present on the listener
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, LocalRateLimitHTTPFilter)
+	if filters[0].GetConfig().Fields["token_bucket"] != nil {
+		log.Fatalf("Listener should not have a token bucket for per route limits")
+	}
+	if !proto.Equal(routeConfig.GeneratePerFilterConfig()[LocalRateLimitHTTPFilter], routeLimit.ToEnvoyHTTP("limited")) {
+		log.Fatalf("Rate limit is not set on the route")
+	}
+
+	routeLimit.PerListener = true
+	if routeConfig.GeneratePerFilterConfig() != nil {
+		log.Fatalf("Listener wide rate limit should not be set on the route")
+	}
+	if !proto.Equal(listener.GenerateHTTPFilters()[0].GetConfig(), routeLimit.ToEnvoyHTTP("foobar")) {
+		log.Fatalf("Rate limit is not set on the listener")
+	}
+
+	// tcp listeners limit connections using the network filter
+	listener.Type = TCP
+	listenerEnvoy, err := listener.ToEnvoy([]*route.VirtualHost{{Name: "foobar"}})
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+	filterChainFilters := listenerEnvoy.FilterChains[0].Filters
+	testutils.AssertInt(len(filterChainFilters), 2)
+	testutils.AssertString(filterChainFilters[0].Name, LocalRateLimitNetworkFilter)
+	testutils.AssertString(filterChainFilters[1].Name, util.TCPProxy)
+}
+
+func TestGlobalRateLimit(T *testing.T) {
+	routeConfig := &RouteConfig{Name: "quota", RateLimitDescriptors: []*RateLimitDescriptorConfig{
+		{Actions: []*RateLimitActionConfig{{GenericKey: "quota"}, {Header: "x-api-key", DescriptorKey: "api_key"}}},
+		{Actions: []*RateLimitActionConfig{{RemoteAddress: true}, {}}},
+		{Actions: []*RateLimitActionConfig{{Header: "x-tenant"}}},
+		{},
+	}}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{routeConfig}}}}
+
+	_rateLimits := []*route.RateLimit{{
+		Actions: []*route.RateLimit_Action{{
+			ActionSpecifier: &route.RateLimit_Action_GenericKey_{GenericKey: &route.RateLimit_Action_GenericKey{DescriptorValue: "quota"}},
+		}, {
+			ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: "x-api-key", DescriptorKey: "api_key"}},
+		}},
+	}, {
+		Actions: []*route.RateLimit_Action{{
+			ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{RemoteAddress: &route.RateLimit_Action_RemoteAddress{}},
+		}},
+	}, {
+		// the header name stands in for the missing descriptor key
+		Actions: []*route.RateLimit_Action{{
+			ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: "x-tenant", DescriptorKey: "x-tenant"}},
+		}},
+	}}
+
+	rateLimits := routeConfig.GenerateRateLimits()
+	testutils.AssertInt(len(rateLimits), len(_rateLimits))
+	for i := range rateLimits {
+		if !proto.Equal(rateLimits[i], _rateLimits[i]) {
+			log.Fatalf("Rate limit does not match: %+v vs %+v", rateLimits[i], _rateLimits[i])
+		}
+		if err := rateLimits[i].Validate(); err != nil {
+			log.Fatalf("Rate limit is not valid: %s", err.Error())
+		}
+	}
+
+	// no rate limit service, no filter
+	RateLimitCluster = ""
+	testutils.AssertInt(len(listener.GenerateHTTPFilters()), 1)
+
+	RateLimitCluster = "ratelimit_cluster"
+	defer func() { RateLimitCluster = "" }()
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, util.HTTPRateLimit)
+
+	_filterConfig, _ := util.MessageToStruct(&ratelimitfilter.RateLimit{
+		Domain: RateLimitDomain,
+		RateLimitService: &ratelimit.RateLimitServiceConfig{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "ratelimit_cluster"},
+				},
+			},
+		},
+	})
+	if !proto.Equal(filters[0].GetConfig(), _filterConfig) {
+		log.Fatalf("Rate limit filter does not match: %+v vs %+v", filters[0].GetConfig(), _filterConfig)
+	}
+}
+
+func TestHeaders(T *testing.T) {
+	first := &RouteConfig{Name: "a", PathPrefix: "/a",
+		Headers: &HeadersConfig{
+			RequestHeadersToAdd:     []*HeaderValueConfig{{Name: "x-client", Value: "%DOWNSTREAM_REMOTE_ADDRESS%"}},
+			ResponseHeadersToRemove: []string{"server"},
+		},
+		VHostHeaders: &HeadersConfig{
+			ResponseHeadersToAdd:    []*HeaderValueConfig{{Name: "strict-transport-security", Value: "max-age=31536000"}},
+			ResponseHeadersToRemove: []string{"x-powered-by"},
+		},
+	}
+	second := &RouteConfig{Name: "b", PathPrefix: "/b",
+		VHostHeaders: &HeadersConfig{
+			ResponseHeadersToAdd:    []*HeaderValueConfig{{Name: "Strict-Transport-Security", Value: "max-age=0"}, {Name: "x-via", Value: "propsy", Append: true}},
+			ResponseHeadersToRemove: []string{"X-Powered-By", "x-version"},
+		},
+	}
+
+	_requestHeaders := []*core.HeaderValueOption{{
+		Header: &core.HeaderValue{Key: "x-client", Value: "%DOWNSTREAM_REMOTE_ADDRESS%"},
+		Append: &types.BoolValue{Value: false},
+	}}
+	envoyRoute := first.ToEnvoy(nil)
+	testutils.AssertInt(len(envoyRoute.RequestHeadersToAdd), 1)
+	if !proto.Equal(envoyRoute.RequestHeadersToAdd[0], _requestHeaders[0]) {
+		log.Fatalf("Request header does not match: %+v vs %+v", envoyRoute.RequestHeadersToAdd[0], _requestHeaders[0])
+	}
+	testutils.AssertInt(len(envoyRoute.ResponseHeadersToRemove), 1)
+	testutils.AssertString(envoyRoute.ResponseHeadersToRemove[0], "server")
+	if len(second.ToEnvoy(nil).RequestHeadersToAdd) != 0 {
+		log.Fatalf("Route without headers should not add any")
+	}
+
+	// the first route in order wins, the removals are merged
+	vhost := &VirtualHost{Name: "*", Routes: []*RouteConfig{first, second}}
+	envoyVHost := vhost.ToEnvoy(nil)
+	_responseHeaders := []*core.HeaderValueOption{{
+		Header: &core.HeaderValue{Key: "strict-transport-security", Value: "max-age=31536000"},
+		Append: &types.BoolValue{Value: false},
+	}, {
+		Header: &core.HeaderValue{Key: "x-via", Value: "propsy"},
+		Append: &types.BoolValue{Value: true},
+	}}
+	testutils.AssertInt(len(envoyVHost.ResponseHeadersToAdd), len(_responseHeaders))
+	for i := range _responseHeaders {
+		if !proto.Equal(envoyVHost.ResponseHeadersToAdd[i], _responseHeaders[i]) {
+			log.Fatalf("Response header does not match: %+v vs %+v", envoyVHost.ResponseHeadersToAdd[i], _responseHeaders[i])
+		}
+	}
+	testutils.AssertInt(len(envoyVHost.ResponseHeadersToRemove), 2)
+	testutils.AssertString(envoyVHost.ResponseHeadersToRemove[0], "x-powered-by")
+	testutils.AssertString(envoyVHost.ResponseHeadersToRemove[1], "x-version")
+}
+
+func TestRedirect(T *testing.T) {
+	redirectRoute := &RouteConfig{Name: "redirect", PathPrefix: "/old",
+		Redirect: &RedirectConfig{HTTPSRedirect: true, Host: "example.com", PrefixRewrite: "/new", ResponseCode: 308, StripQuery: true}}
+	if redirectRoute.IsForwarding() {
+		log.Fatalf("Redirect route should not forward")
+	}
+
+	_redirect := &route.RedirectAction{
+		SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{HttpsRedirect: true},
+		HostRedirect:           "example.com",
+		PathRewriteSpecifier:   &route.RedirectAction_PrefixRewrite{PrefixRewrite: "/new"},
+		ResponseCode:           route.RedirectAction_PERMANENT_REDIRECT,
+		StripQuery:             true,
+	}
+	if !proto.Equal(redirectRoute.ToEnvoy(nil).GetRedirect(), _redirect) {
+		log.Fatalf("Redirect does not match: %+v vs %+v", redirectRoute.ToEnvoy(nil).GetRedirect(), _redirect)
+	}
+	if redirectRoute.ToEnvoy(nil).GetRoute() != nil {
+		log.Fatalf("Redirect route should not route to clusters")
+	}
+
+	// path wins over the prefix rewrite
+	redirectRoute.Redirect = &RedirectConfig{Path: "/", PrefixRewrite: "/new"}
+	_redirect = &route.RedirectAction{
+		PathRewriteSpecifier: &route.RedirectAction_PathRedirect{PathRedirect: "/"},
+		ResponseCode:         route.RedirectAction_MOVED_PERMANENTLY,
+	}
+	if !proto.Equal(redirectRoute.ToEnvoy(nil).GetRedirect(), _redirect) {
+		log.Fatalf("Redirect does not match: %+v vs %+v", redirectRoute.ToEnvoy(nil).GetRedirect(), _redirect)
+	}
+}
+
+func TestDirectResponse(T *testing.T) {
+	directRoute := &RouteConfig{Name: "direct", PathPrefix: "/health", DirectResponse: &DirectResponseConfig{Status: 200, Body: "OK"}}
+	if directRoute.IsForwarding() {
+		log.Fatalf("Direct response route should not forward")
+	}
+
+	_directResponse := &route.DirectResponseAction{
+		Status: 200,
+		Body:   &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: "OK"}},
+	}
+	if !proto.Equal(directRoute.ToEnvoy(nil).GetDirectResponse(), _directResponse) {
+		log.Fatalf("Direct response does not match: %+v vs %+v", directRoute.ToEnvoy(nil).GetDirectResponse(), _directResponse)
+	}
+
+	directRoute.DirectResponse.Body = ""
+	if directRoute.ToEnvoy(nil).GetDirectResponse().Body != nil {
+		log.Fatalf("Direct response should have no body")
+	}
+}
+
+func TestCors(T *testing.T) {
+	routeCors := &CorsConfig{AllowOrigins: []string{"https://example.com"}, AllowMethods: []string{"GET", "POST"}, MaxAge: 600}
+	vhostCors := &CorsConfig{AllowOriginRegex: []string{"https://.*\\.example\\.com"}, ExposeHeaders: []string{"x-request-id"}, AllowCredentials: true, PerVHost: true}
+	api := &RouteConfig{Name: "api", PathPrefix: "/api", Cors: routeCors}
+	web := &RouteConfig{Name: "web", PathPrefix: "/", Cors: vhostCors}
+	vhost := &VirtualHost{Name: "*", Routes: []*RouteConfig{api, web}}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{vhost}}
+
+	_routeCors := &route.CorsPolicy{
+		AllowOrigin:      []string{"https://example.com"},
+		AllowMethods:     "GET,POST",
+		MaxAge:           "600",
+		AllowCredentials: &types.BoolValue{Value: false},
+	}
+	if !proto.Equal(api.ToEnvoy(nil).GetRoute().Cors, _routeCors) {
+		log.Fatalf("Route CORS does not match: %+v vs %+v", api.ToEnvoy(nil).GetRoute().Cors, _routeCors)
+	}
+	if web.ToEnvoy(nil).GetRoute().Cors != nil {
+		log.Fatalf("Vhost CORS should not be set on the route")
+	}
+
+	_vhostCors := &route.CorsPolicy{
+		AllowOriginRegex: []string{"https://.*\\.example\\.com"},
+		ExposeHeaders:    "x-request-id",
+		AllowCredentials: &types.BoolValue{Value: true},
+	}
+	if !proto.Equal(vhost.ToEnvoy(nil).Cors, _vhostCors) {
+		log.Fatalf("Vhost CORS does not match: %+v vs %+v", vhost.ToEnvoy(nil).Cors, _vhostCors)
+	}
+
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, util.CORS)
+
+	api.Cors, web.Cors = nil, nil
+	if vhost.ToEnvoy(nil).Cors != nil {
+		log.Fatalf("Vhost should have no CORS policy")
+	}
+	testutils.AssertInt(len(listener.GenerateHTTPFilters()), 1)
+}
+
+func TestAccessLog(T *testing.T) {
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{{Name: "a"}}}}}
+
+	// nothing configured, nothing logged
+	if listener.GenerateHCM(nil).AccessLog != nil {
+		log.Fatalf("Access log should not be set up by default")
+	}
+
+	DefaultAccessLog = &AccessLogConfig{Path: "/dev/stdout", Format: `{"status": "%RESPONSE_CODE%"}`, MinStatus: 500}
+	defer func() { DefaultAccessLog = &AccessLogConfig{} }()
+
+	_fileConfig, _ := util.MessageToStruct(&accesslogconfig.FileAccessLog{
+		Path: "/dev/stdout",
+		AccessLogFormat: &accesslogconfig.FileAccessLog_JsonFormat{JsonFormat: &types.Struct{Fields: map[string]*types.Value{
+			"status": StringValue("%RESPONSE_CODE%"),
+		}}},
+	})
+	_accessLog := &accesslog.AccessLog{
+		Name: util.FileAccessLog,
+		Filter: &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_StatusCodeFilter{
+				StatusCodeFilter: &accesslog.StatusCodeFilter{
+					Comparison: &accesslog.ComparisonFilter{
+						Op:    accesslog.ComparisonFilter_GE,
+						Value: &core.RuntimeUInt32{DefaultValue: 500, RuntimeKey: "access_log.foobar.min_status"},
+					},
+				},
+			},
+		},
+		ConfigType: &accesslog.AccessLog_Config{Config: _fileConfig},
+	}
+	accessLogs := listener.GenerateHCM(nil).AccessLog
+	testutils.AssertInt(len(accessLogs), 1)
+	if !proto.Equal(accessLogs[0], _accessLog) {
+		log.Fatalf("Access log does not match: %+v vs %+v", accessLogs[0], _accessLog)
+	}
+
+	// the route overrides the default, tcp logs to the tcp service and ignores status codes
+	listener.Type = TCP
+	listener.VirtualHosts[0].Routes[0].AccessLog = &AccessLogConfig{Cluster: "als", Format: "%START_TIME%", MinStatus: 500, SamplePercent: 10}
+	_grpcConfig, _ := util.MessageToStruct(&accesslogconfig.TcpGrpcAccessLogConfig{
+		CommonConfig: &accesslogconfig.CommonGrpcAccessLogConfig{
+			LogName: "foobar",
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "als"}},
+			},
+		},
+	})
+	_accessLog = &accesslog.AccessLog{
+		Name: TCPGRPCAccessLog,
+		Filter: &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_RuntimeFilter{
+				RuntimeFilter: &accesslog.RuntimeFilter{RuntimeKey: "access_log.foobar.sample", PercentSampled: PercentToEnvoy(10)},
+			},
+		},
+		ConfigType: &accesslog.AccessLog_Config{Config: _grpcConfig},
+	}
+	accessLogs = listener.GenerateTCP(nil).AccessLog
+	testutils.AssertInt(len(accessLogs), 1)
+	if !proto.Equal(accessLogs[0], _accessLog) {
+		log.Fatalf("Access log does not match: %+v vs %+v", accessLogs[0], _accessLog)
+	}
+
+	// text format
+	fileAccessLog := (&AccessLogConfig{Path: "/var/log/envoy.log", Format: "%START_TIME% %RESPONSE_CODE%\n"}).GenerateFileAccessLog()
+	testutils.AssertString(fileAccessLog.GetFormat(), "%START_TIME% %RESPONSE_CODE%\n")
+
+	listener.VirtualHosts[0].Routes[0].AccessLog = &AccessLogConfig{Disabled: true}
+	if listener.GenerateTCP(nil).AccessLog != nil {
+		log.Fatalf("Access log should be disabled")
+	}
+}
+
+func TestCompression(T *testing.T) {
+	text := &RouteConfig{Name: "text", PathPrefix: "/text", Compression: &CompressionConfig{ContentTypes: []string{"text/plain"}, MinLength: 1024, Level: BestCompression}}
+	binary := &RouteConfig{Name: "binary", PathPrefix: "/binary", Compression: &CompressionConfig{Disabled: true}}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{binary, text}}}}
+
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, util.Gzip)
+	_filterConfig, _ := util.MessageToStruct(&gzip.Gzip{
+		ContentLength:    &types.UInt32Value{Value: 1024},
+		CompressionLevel: gzip.Gzip_CompressionLevel_BEST,
+		ContentType:      []string{"text/plain"},
+	})
+	if !proto.Equal(filters[0].GetConfig(), _filterConfig) {
+		log.Fatalf("Gzip filter does not match: %+v vs %+v", filters[0].GetConfig(), _filterConfig)
+	}
+
+	// the route opting out marks its responses so the gzip filter skips them, next to its own headers
+	binary.Headers = &HeadersConfig{ResponseHeadersToAdd: []*HeaderValueConfig{{Name: "x-served-by", Value: "propsy"}}}
+	envoyRoute := binary.ToEnvoy(nil)
+	DisableCompression(envoyRoute)
+	_noTransform := &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: "cache-control", Value: "no-transform"},
+		Append: &types.BoolValue{Value: true},
+	}
+	testutils.AssertInt(len(envoyRoute.ResponseHeadersToAdd), 2)
+	if !proto.Equal(envoyRoute.ResponseHeadersToAdd[1], _noTransform) {
+		log.Fatalf("Route should disable compression: %+v", envoyRoute.ResponseHeadersToAdd)
+	}
+
+	text.Compression = nil
+	testutils.AssertInt(len(listener.GenerateHTTPFilters()), 1)
+}
+
+func TestExtAuthz(T *testing.T) {
+	authz := &ClusterConfig{Name: "0-ns-sso", IsAuthz: true, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-sso", ServicePort: 9001, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "10.0.0.3", Weight: 1, Healthy: true}},
+	}}
+	primary := &ClusterConfig{Name: "0-ns-app", Weight: 100, EndpointConfig: &EndpointConfig{
+		Name: "0-ns-app", ServicePort: 8080, Locality: &Locality{Zone: "test"},
+		Endpoints: []*Endpoint{{Host: "10.0.0.1", Weight: 1, Healthy: true}},
+	}}
+	internal := &RouteConfig{Name: "internal", PathPrefix: "/internal", Clusters: []*ClusterConfig{primary, authz},
+		ExtAuthz: &ExtAuthzConfig{Service: "ns/sso", GRPC: true, Timeout: time.Second}}
+	public := &RouteConfig{Name: "public", PathPrefix: "/"}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{internal, public}}}}
+
+	// the authorization service is not a backend of the route
+	if internal.GetLocalBestCluster(false) != primary || internal.GetLocalBestAuthz() != authz {
+		log.Fatalf("Wrong local clusters")
+	}
+	totalWeight, _, _, _, _, _ := internal.CalculateWeights()
+	testutils.AssertInt(totalWeight, 100)
+	testutils.AssertInt(len(internal.GeneratePrioritizedEndpoints(LocalZone)), 1)
+	authzEndpoints := internal.GenerateAuthzEndpoints()
+	testutils.AssertInt(len(authzEndpoints), 1)
+	testutils.AssertInt(int(authzEndpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().GetPortValue()), 9001)
+
+	testutils.AssertString(listener.GetExtAuthzRoute().Name, "internal")
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, util.HTTPExternalAuthorization)
+	_filterConfig, _ := util.MessageToStruct(&extauthz.ExtAuthz{
+		Services: &extauthz.ExtAuthz_GrpcService{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "foobar-authz"}},
+				Timeout:         &types.Duration{Seconds: 1},
+			},
+		},
+	})
+	if !proto.Equal(filters[0].GetConfig(), _filterConfig) {
+		log.Fatalf("Authorization filter does not match: %+v vs %+v", filters[0].GetConfig(), _filterConfig)
+	}
+
+	// http service
+	timeout := 200 * time.Millisecond
+	httpAuthz := (&ExtAuthzConfig{PathPrefix: "/check", Timeout: timeout}).ToEnvoy("foobar-authz")
+	_httpAuthz := &extauthz.ExtAuthz{
+		Services: &extauthz.ExtAuthz_HttpService{
+			HttpService: &extauthz.HttpService{
+				ServerUri: &core.HttpUri{
+					Uri:              "http://foobar-authz",
+					HttpUpstreamType: &core.HttpUri_Cluster{Cluster: "foobar-authz"},
+					Timeout:          &timeout,
+				},
+				PathPrefix: "/check",
+			},
+		},
+	}
+	if !proto.Equal(httpAuthz, _httpAuthz) {
+		log.Fatalf("HTTP authorization does not match: %+v vs %+v", httpAuthz, _httpAuthz)
+	}
+
+	internal.ExtAuthz = nil
+	if listener.GetExtAuthzRoute() != nil {
+		log.Fatalf("Listener should have no authorization")
+	}
+}
+
+func TestJWT(T *testing.T) {
+	keys := &TlsData{JWKS: []byte(`{"keys":[]}`)}
+	secure := &RouteConfig{Name: "secure", PathPrefix: "/secure",
+		JWT: &JWTConfig{Issuer: "https://sso.example.com", Audiences: []string{"app"}, JWKS: keys, Forward: true}}
+	public := &RouteConfig{Name: "public", PathPrefix: "/"}
+	remote := &RouteConfig{Name: "remote", PathPrefix: "/",
+		JWT: &JWTConfig{Issuer: "https://sso.example.com", RemoteJWKSURI: "https://sso.example.com/jwks.json", RemoteJWKSCluster: "sso"}}
+	api := &VirtualHost{Name: "api", Domains: []string{"api.example.com", "*.api.example.com"}, Routes: []*RouteConfig{secure, public}}
+	catchAll := &VirtualHost{Name: "*", Domains: []string{"*"}, Routes: []*RouteConfig{remote}}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{catchAll, api}}
+
+	jwtAuthentication := listener.GenerateJWTAuthentication()
+	testutils.AssertInt(len(jwtAuthentication.Providers), 2)
+	testutils.AssertInt(len(jwtAuthentication.Rules), 3)
+
+	// rules follow the route order and routes without JWT get a rule without requirements
+	_authority := &route.HeaderMatcher{
+		Name:                 ":authority",
+		HeaderMatchSpecifier: &route.HeaderMatcher_RegexMatch{RegexMatch: `(api\.example\.com|.*\.api\.example\.com)(:[0-9]+)?`},
+	}
+	_secureRule := &jwtauthn.RequirementRule{
+		Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/secure"}, Headers: []*route.HeaderMatcher{_authority}},
+		Requires: &jwtauthn.JwtRequirement{
+			RequiresType: &jwtauthn.JwtRequirement_ProviderName{ProviderName: GenerateJWTProviderName(api, secure)},
+		},
+	}
+	if !proto.Equal(jwtAuthentication.Rules[0], _secureRule) {
+		log.Fatalf("JWT rule does not match: %+v vs %+v", jwtAuthentication.Rules[0], _secureRule)
+	}
+	if jwtAuthentication.Rules[1].Requires != nil || len(jwtAuthentication.Rules[1].Match.Headers) != 1 {
+		log.Fatalf("Public route shouldn't require JWT: %+v", jwtAuthentication.Rules[1])
+	}
+	if jwtAuthentication.Rules[2].Requires == nil || len(jwtAuthentication.Rules[2].Match.Headers) != 0 {
+		log.Fatalf("Catch-all route should require JWT on any host: %+v", jwtAuthentication.Rules[2])
+	}
+
+	_localProvider := &jwtauthn.JwtProvider{
+		Issuer:    "https://sso.example.com",
+		Audiences: []string{"app"},
+		Forward:   true,
+		JwksSourceSpecifier: &jwtauthn.JwtProvider_LocalJwks{
+			LocalJwks: &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: `{"keys":[]}`}},
+		},
+	}
+	if !proto.Equal(jwtAuthentication.Providers[GenerateJWTProviderName(api, secure)], _localProvider) {
+		log.Fatalf("Local JWT provider does not match: %+v", jwtAuthentication.Providers)
+	}
+	timeout := time.Second
+	_remoteProvider := &jwtauthn.JwtProvider{
+		Issuer: "https://sso.example.com",
+		JwksSourceSpecifier: &jwtauthn.JwtProvider_RemoteJwks{
+			RemoteJwks: &jwtauthn.RemoteJwks{HttpUri: &core.HttpUri{
+				Uri:              "https://sso.example.com/jwks.json",
+				HttpUpstreamType: &core.HttpUri_Cluster{Cluster: "sso"},
+				Timeout:          &timeout,
+			}},
+		},
+	}
+	if !proto.Equal(jwtAuthentication.Providers[GenerateJWTProviderName(catchAll, remote)], _remoteProvider) {
+		log.Fatalf("Remote JWT provider does not match: %+v", jwtAuthentication.Providers)
+	}
+
+	filters := listener.GenerateHTTPFilters()
+	testutils.AssertInt(len(filters), 2)
+	testutils.AssertString(filters[0].Name, JWTAuthnHTTPFilter)
+
+	secure.JWT, remote.JWT = nil, nil
+	if len(listener.GenerateHTTPFilters()) != 1 {
+		log.Fatalf("Listener without JWT shouldn't verify tokens")
+	}
+}
+
+func TestJWTWildcardVHost(T *testing.T) {
+	open := &RouteConfig{Name: "open", PathPrefix: "/"}
+	secure := &RouteConfig{Name: "secure", PathPrefix: "/",
+		JWT: &JWTConfig{Issuer: "https://sso.example.com", JWKS: &TlsData{JWKS: []byte(`{"keys":[]}`)}}}
+	wildcard := &VirtualHost{Name: "*.example.cz", Domains: []string{"*.example.cz", "www.*"}, Routes: []*RouteConfig{open}}
+	api := &VirtualHost{Name: "api.example.cz", Domains: []string{"api.example.cz", "*.api.example.cz"}, Routes: []*RouteConfig{secure}}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{wildcard, api}}
+
+	// '*' sorts before the letters, yet the exact and the longer wildcard domains have to be matched first
+	jwtAuthentication := listener.GenerateJWTAuthentication()
+	testutils.AssertInt(len(jwtAuthentication.Rules), 2)
+	testutils.AssertString(jwtAuthentication.Rules[0].Match.Headers[0].GetRegexMatch(), `(api\.example\.cz|.*\.api\.example\.cz)(:[0-9]+)?`)
+	if jwtAuthentication.Rules[0].Requires == nil {
+		log.Fatalf("Exact vhost should require JWT before the wildcard one: %+v", jwtAuthentication.Rules[0])
+	}
+	testutils.AssertString(jwtAuthentication.Rules[1].Match.Headers[0].GetRegexMatch(), `(.*\.example\.cz|www\..*)(:[0-9]+)?`)
+	if jwtAuthentication.Rules[1].Requires != nil {
+		log.Fatalf("Wildcard vhost shouldn't require JWT: %+v", jwtAuthentication.Rules[1])
+	}
+
+	// a wildcard domain of the vhost that is less specific than another vhost's one gets a rule of its own
+	api.Domains = []string{"api.example.cz", "*.cz"}
+	jwtAuthentication = listener.GenerateJWTAuthentication()
+	testutils.AssertInt(len(jwtAuthentication.Rules), 4)
+	_authorities := []string{
+		`(api\.example\.cz)(:[0-9]+)?`,
+		`(.*\.example\.cz)(:[0-9]+)?`,
+		`(.*\.cz)(:[0-9]+)?`,
+		`(www\..*)(:[0-9]+)?`,
+	}
+	for i := range _authorities {
+		testutils.AssertString(jwtAuthentication.Rules[i].Match.Headers[0].GetRegexMatch(), _authorities[i])
+		if (jwtAuthentication.Rules[i].Requires != nil) != (i%2 == 0) {
+			log.Fatalf("Rule should follow the vhost of its domains: %+v", jwtAuthentication.Rules[i])
+		}
+	}
+}
+
+func TestWebSocket(T *testing.T) {
+	chat := &RouteConfig{Name: "chat", PathPrefix: "/chat", WebSocket: true}
+	api := &RouteConfig{Name: "api", PathPrefix: "/"}
+	listener := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{{Name: "*", Routes: []*RouteConfig{chat, api}}}}
+
+	// upgrades are disabled by default and only the websocket routes enable them
+	_hcmUpgrades := []*v2.HttpConnectionManager_UpgradeConfig{{UpgradeType: "websocket", Enabled: &types.BoolValue{Value: false}}}
+	hcm := listener.GenerateHCM(nil)
+	testutils.AssertInt(len(hcm.UpgradeConfigs), 1)
+	if !proto.Equal(hcm.UpgradeConfigs[0], _hcmUpgrades[0]) {
+		log.Fatalf("Listener upgrades do not match: %+v vs %+v", hcm.UpgradeConfigs, _hcmUpgrades)
+	}
+
+	_routeUpgrade := &route.RouteAction_UpgradeConfig{UpgradeType: "websocket", Enabled: &types.BoolValue{Value: true}}
+	chatUpgrades := chat.ToEnvoy(nil).GetRoute().UpgradeConfigs
+	testutils.AssertInt(len(chatUpgrades), 1)
+	if !proto.Equal(chatUpgrades[0], _routeUpgrade) {
+		log.Fatalf("Route upgrades do not match: %+v vs %+v", chatUpgrades[0], _routeUpgrade)
+	}
+	if api.ToEnvoy(nil).GetRoute().UpgradeConfigs != nil {
+		log.Fatalf("Plain route shouldn't allow websockets")
+	}
+
+	chat.WebSocket = false
+	if listener.GenerateHCM(nil).UpgradeConfigs != nil {
+		log.Fatalf("Listener without websockets shouldn't allow upgrades")
+	}
+}
+
+func TestGRPCTimeout(T *testing.T) {
+	grpc := &RouteConfig{Name: "grpc", PathPrefix: "/", Timeout: 5 * time.Second, GRPC: true}
+	maxGrpcTimeout := grpc.ToEnvoy(nil).GetRoute().MaxGrpcTimeout
+	if maxGrpcTimeout == nil || *maxGrpcTimeout != 5*time.Second {
+		log.Fatalf("gRPC timeout should be capped by the route timeout: %v", maxGrpcTimeout)
+	}
+
+	grpc.GRPC = false
+	if grpc.ToEnvoy(nil).GetRoute().MaxGrpcTimeout != nil {
+		log.Fatalf("HTTP routes should ignore the grpc-timeout header")
+	}
+}
+
+func TestUDP(T *testing.T) {
+	dns := &RouteConfig{Name: "dns", PathPrefix: "/"}
+	vhost := &VirtualHost{Name: "*", Domains: []string{"*"}, Routes: []*RouteConfig{dns}}
+	listener := ListenerConfig{Name: GenerateListenerName("53", UDP), Listen: "53", Type: UDP, VirtualHosts: []*VirtualHost{vhost}}
+
+	// tcp and udp can listen on the same port
+	if listener.Name == GenerateListenerName("53", TCP) {
+		log.Fatalf("TCP and UDP listeners on one port share the name %s", listener.Name)
+	}
+
+	envoyListener, err := listener.ToEnvoy(nil)
+	if err != nil {
+		log.Fatalf("Error generating UDP listener: %s", err.Error())
+	}
+	if envoyListener.GetAddress().GetSocketAddress().Protocol != core.UDP || len(envoyListener.FilterChains) != 0 {
+		log.Fatalf("Listener should receive UDP without any filter chain: %+v", envoyListener)
+	}
+	testutils.AssertInt(int(envoyListener.GetAddress().GetSocketAddress().GetPortValue()), 53)
+
+	testutils.AssertInt(len(envoyListener.ListenerFilters), 1)
+	testutils.AssertString(envoyListener.ListenerFilters[0].Name, UDPProxyListenerFilter)
+	_udpProxy := &types.Struct{Fields: map[string]*types.Value{
+		"stat_prefix": StringValue(listener.Name),
+		"cluster":     StringValue(GenerateClusterName(listener.Name, vhost, dns)),
+	}}
+	if !proto.Equal(envoyListener.ListenerFilters[0].GetConfig(), _udpProxy) {
+		log.Fatalf("UDP proxy does not match: %+v vs %+v", envoyListener.ListenerFilters[0].GetConfig(), _udpProxy)
+	}
+
+	listener.VirtualHosts = nil
+	if _, err := listener.ToEnvoy(nil); err == nil {
+		log.Fatalf("UDP listener without a service should fail")
+	}
+}
+
+func TestTCPServerNames(T *testing.T) {
+	listener := ListenerConfig{Name: "foobar", Type: TCP, VirtualHosts: []*VirtualHost{
+		{Name: "db.example.cz", Domains: []string{"db.example.cz"}},
+		{Name: "mq.example.cz", Domains: []string{"mq.example.cz"}, TLSSecret: &TlsData{Name: "ns__mq", Certificate: []byte("mq-crt"), Key: []byte("mq-key")}},
+		{Name: "*", Domains: []string{"*"}},
+	}}
+	vhosts := []*route.VirtualHost{
+		{Name: "db.example.cz", Domains: []string{"db.example.cz"}},
+		{Name: "mq.example.cz", Domains: []string{"mq.example.cz"}},
+		{Name: "*", Domains: []string{"*"}},
+	}
+
+	envoyListener, err := listener.ToEnvoy(vhosts)
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+	testutils.AssertInt(len(envoyListener.ListenerFilters), 1)
+	testutils.AssertString(envoyListener.ListenerFilters[0].Name, util.TlsInspector)
+
+	// every service gets its own tcp proxy, the one without domains catches the rest
+	filterChains := envoyListener.FilterChains
+	testutils.AssertInt(len(filterChains), 3)
+	testutils.AssertString(filterChains[0].FilterChainMatch.ServerNames[0], "db.example.cz")
+	testutils.AssertString(filterChains[1].FilterChainMatch.ServerNames[0], "mq.example.cz")
+	if filterChains[2].FilterChainMatch != nil {
+		log.Fatalf("The default filter chain shouldn't match SNI: %+v", filterChains[2].FilterChainMatch)
+	}
+	for i := range filterChains {
+		testutils.AssertInt(len(filterChains[i].Filters), 1)
+		testutils.AssertString(filterChains[i].Filters[0].Name, util.TCPProxy)
+	}
+	_tcpProxy, _ := util.MessageToStruct(listener.GenerateTCP(listener.GenerateWeightedCluster(vhosts[1])))
+	if !proto.Equal(filterChains[1].Filters[0].GetConfig(), _tcpProxy) {
+		log.Fatalf("TCP proxy does not match: %+v vs %+v", filterChains[1].Filters[0].GetConfig(), _tcpProxy)
+	}
+
+	// tls is passed through unless the service has a certificate
+	if filterChains[0].TlsContext != nil || filterChains[2].TlsContext != nil {
+		log.Fatalf("TLS should be passed through to the services")
+	}
+	if filterChains[1].TlsContext == nil {
+		log.Fatalf("TLS should be terminated for mq.example.cz")
+	}
+
+	if _, err := listener.ToEnvoy(nil); err == nil {
+		log.Fatalf("TCP listener without any vhost should fail")
+	}
+}
+
+func TestAcceptProxyProtocol(T *testing.T) {
+	db := &RouteConfig{Name: "db", PathPrefix: "/", AcceptProxyProtocol: true}
+	mq := &RouteConfig{Name: "mq", PathPrefix: "/"}
+	listener := ListenerConfig{Name: "foobar", Type: TCP, VirtualHosts: []*VirtualHost{
+		{Name: "mq.example.cz", Domains: []string{"mq.example.cz"}, Routes: []*RouteConfig{mq}},
+		{Name: "db.example.cz", Domains: []string{"db.example.cz"}, Routes: []*RouteConfig{db}},
+	}}
+	vhosts := []*route.VirtualHost{
+		{Name: "db.example.cz", Domains: []string{"db.example.cz"}},
+		{Name: "mq.example.cz", Domains: []string{"mq.example.cz"}},
+	}
+
+	// the first route in order decides for the whole listener
+	if !listener.AcceptsProxyProtocol() {
+		log.Fatalf("Listener should accept the PROXY protocol")
+	}
+
+	// the header has to be read before the tls inspector looks for SNI
+	envoyListener, err := listener.ToEnvoy(vhosts)
+	if err != nil {
+		log.Fatalf("Error generating listener: %s", err.Error())
+	}
+	testutils.AssertInt(len(envoyListener.ListenerFilters), 2)
+	testutils.AssertString(envoyListener.ListenerFilters[0].Name, util.ProxyProtocol)
+	testutils.AssertString(envoyListener.ListenerFilters[1].Name, util.TlsInspector)
+
+	db.AcceptProxyProtocol, mq.AcceptProxyProtocol = false, true
+	if listener.AcceptsProxyProtocol() {
+		log.Fatalf("Listener shouldn't accept the PROXY protocol")
+	}
+	envoyListener, _ = listener.ToEnvoy(vhosts)
+	testutils.AssertInt(len(envoyListener.ListenerFilters), 1)
+	testutils.AssertString(envoyListener.ListenerFilters[0].Name, util.TlsInspector)
+}
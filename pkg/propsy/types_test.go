@@ -75,10 +75,10 @@ func TestNodeConfig(T *testing.T) {
 		log.Fatalf("Found a non-existing endpoint!")
 	}
 	epc := node.FindListener("foobar").FindVHost("foobar").FindRoute("foobar").FindCluster("foobar").EndpointConfig.ToEnvoy(2, 3)
-	epc_orig := endpoint.LocalityLbEndpoints{
+	epc_orig := &endpoint.LocalityLbEndpoints{
 		LoadBalancingWeight: UInt32FromInteger(3),
 		Priority:            uint32(2),
-		LbEndpoints: []endpoint.LbEndpoint{
+		LbEndpoints: []*endpoint.LbEndpoint{
 			{
 				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 					Endpoint: &endpoint.Endpoint{
@@ -202,15 +202,47 @@ func TestListeners(T *testing.T) {
 }
 
 func TestRouteGenerator(T *testing.T) {
-	test, path := GenerateRouteName("foobar/baz")
+	test, path := GenerateRouteName("foobar/baz", nil)
 	testutils.AssertString(test, "_foobar_baz")
 	testutils.AssertString(path, "/foobar/baz")
-	test, path = GenerateRouteName("")
+	test, path = GenerateRouteName("", nil)
 	testutils.AssertString(test, "_")
 	testutils.AssertString(path, "/")
-	test, path = GenerateRouteName("/foo")
+	test, path = GenerateRouteName("/foo", nil)
 	testutils.AssertString(test, "_foo")
 	testutils.AssertString(path, "/foo")
+
+	headerMatch := &MatchConfig{Headers: []*HeaderMatchConfig{
+		{Name: "x-canary", Value: "1", Type: HeaderExactMatch},
+		{Name: ":method", Value: "GET", Type: HeaderExactMatch},
+	}}
+	headerMatchSwapped := &MatchConfig{Headers: []*HeaderMatchConfig{
+		headerMatch.Headers[1], headerMatch.Headers[0],
+	}}
+	test, path = GenerateRouteName("/foo", headerMatch)
+	test2, _ := GenerateRouteName("/foo", headerMatchSwapped)
+	test3, _ := GenerateRouteName("/foo", &MatchConfig{Path: "/foo"})
+	testutils.AssertString(path, "/foo")
+	testutils.AssertString(test, test2)
+	if test == "_foo" || test == test3 {
+		log.Fatalf("Route names for different matches collide: %s, %s", test, test3)
+	}
+	test, _ = GenerateRouteName("/foo", &MatchConfig{})
+	testutils.AssertString(test, "_foo")
+}
+
+func TestVirtualHost_GetSortedRoutes(T *testing.T) {
+	vhost := VirtualHost{Routes: []*RouteConfig{
+		{Name: "plain"},
+		{Name: "header", Match: &MatchConfig{Headers: []*HeaderMatchConfig{{Name: "x-canary", Type: HeaderPresentMatch}}}},
+		{Name: "empty", Match: &MatchConfig{}},
+	}}
+
+	routes := vhost.GetSortedRoutes()
+	testutils.AssertString(routes[0].Name, "header")
+	testutils.AssertString(routes[1].Name, "plain")
+	testutils.AssertString(routes[2].Name, "empty")
+	testutils.AssertString(vhost.Routes[0].Name, "plain")
 }
 
 func TestListenerConfig_Trackers(T *testing.T) {
@@ -227,3 +259,26 @@ func TestListenerConfig_Trackers(T *testing.T) {
 	// TODO this might change when we have proper lower-level priority tracking for PPS
 	testutils.AssertString(lis.GetPriorityTracker(), "")
 }
+
+func TestListenerConfig_GetVHostDomains(T *testing.T) {
+	lis := ListenerConfig{Name: "foobar", VirtualHosts: []*VirtualHost{
+		{Name: "*", Domains: []string{"*"}},
+		{Name: "b.cz", Domains: []string{"b.cz"}},
+		{Name: "a.cz-b.cz", Domains: []string{"a.cz", "b.cz"}},
+	}}
+
+	vhosts := lis.GetSortedVHosts()
+	testutils.AssertString(vhosts[0].Name, "a.cz-b.cz")
+	testutils.AssertString(vhosts[1].Name, "b.cz")
+	testutils.AssertString(vhosts[2].Name, "*")
+
+	domains := lis.GetVHostDomains()
+	if !reflect.DeepEqual(domains["a.cz-b.cz"], []string{"a.cz", "b.cz"}) {
+		log.Fatalf("Wrong domains for a.cz-b.cz: %v", domains["a.cz-b.cz"])
+	}
+	testutils.AssertInt(len(domains["b.cz"]), 0)
+	testutils.AssertInt(len(domains["*"]), 1)
+
+	testutils.AssertString(GenerateClusterName("lis", vhosts[2], &RouteConfig{PathPrefix: "/foo"}), "lis_-foo")
+	testutils.AssertString(GenerateClusterName("lis", vhosts[1], &RouteConfig{PathPrefix: "/foo"}), "lis_b.cz_-foo")
+}